@@ -0,0 +1,497 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	retentionBuckets = 100
+
+	// maxHeartbeatSpan is the longest playback a heartbeat can report.
+	maxHeartbeatSpan = 60
+)
+
+type videoDate struct {
+	videoID string
+	date    string
+}
+
+type retentionKey struct {
+	videoDate
+	bucket int
+}
+
+type playbackSession struct {
+	date     string
+	buckets  [retentionBuckets]bool
+	lastBeat time.Time
+	expires  time.Time
+}
+
+// playbackAggregator sums up heartbeats of players by video and date until
+// they are flushed into the database. Each 1% of a video is counted once
+// per viewer a day for the audience retention.
+type playbackAggregator struct {
+	mu        sync.Mutex
+	window    time.Duration
+	sessions  map[string]*playbackSession
+	watchTime map[videoDate]float64
+	retention map[retentionKey]uint64
+}
+
+func newPlaybackAggregator(window time.Duration) *playbackAggregator {
+	return &playbackAggregator{
+		window:    window,
+		sessions:  map[string]*playbackSession{},
+		watchTime: map[videoDate]float64{},
+		retention: map[retentionKey]uint64{},
+	}
+}
+
+// add records that the viewer watched the video from a position to another.
+// The watch time of a heartbeat can not exceed the time passed since the last
+// heartbeat of the viewer, so repeated heartbeats do not inflate it.
+func (pa *playbackAggregator) add(videoID string, viewer string, duration float64, from float64, to float64, now time.Time) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+
+	if duration > 0 && to > duration {
+		to = duration
+	}
+
+	if to <= from {
+		return
+	}
+
+	key := videoDate{videoID, now.UTC().Format(dateLayout)}
+
+	s, ok := pa.sessions[videoID+"/"+viewer]
+	if !ok || !now.Before(s.expires) {
+		s = &playbackSession{date: key.date}
+		pa.sessions[videoID+"/"+viewer] = s
+	} else if s.date != key.date {
+		s = &playbackSession{date: key.date, lastBeat: s.lastBeat}
+		pa.sessions[videoID+"/"+viewer] = s
+	}
+
+	watched := to - from
+	if !s.lastBeat.IsZero() {
+		watched = math.Min(watched, now.Sub(s.lastBeat).Seconds())
+	}
+	if watched > 0 {
+		pa.watchTime[key] += watched
+	}
+
+	s.lastBeat = now
+	s.expires = now.Add(pa.window)
+
+	if duration <= 0 {
+		return
+	}
+
+	first := int(from / duration * retentionBuckets)
+	last := int(math.Ceil(to/duration*retentionBuckets)) - 1
+	if last >= retentionBuckets {
+		last = retentionBuckets - 1
+	}
+
+	for b := first; b <= last; b++ {
+		if !s.buckets[b] {
+			s.buckets[b] = true
+			pa.retention[retentionKey{key, b}]++
+		}
+	}
+}
+
+// take returns the buffered sums and forgets expired sessions.
+func (pa *playbackAggregator) take(now time.Time) (map[videoDate]float64, map[retentionKey]uint64) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+
+	for key, s := range pa.sessions {
+		if !now.Before(s.expires) {
+			delete(pa.sessions, key)
+		}
+	}
+
+	watchTime, retention := pa.watchTime, pa.retention
+	pa.watchTime = map[videoDate]float64{}
+	pa.retention = map[retentionKey]uint64{}
+	return watchTime, retention
+}
+
+// restore puts back sums which failed to be flushed.
+func (pa *playbackAggregator) restore(watchTime map[videoDate]float64, retention map[retentionKey]uint64) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+
+	for key, t := range watchTime {
+		pa.watchTime[key] += t
+	}
+
+	for key, n := range retention {
+		pa.retention[key] += n
+	}
+}
+
+// viewerKey identifies the viewer of a request by the user, the player
+// session or the IP address in order of preference.
+func viewerKey(c echo.Context, userID string, sessionID string) string {
+	if userID != "" {
+		return "user:" + userID
+	} else if sessionID != "" {
+		return "session:" + sessionID
+	}
+
+	return "ip:" + c.RealIP()
+}
+
+func (app *App) PostVideoHeartbeat(c echo.Context) error {
+	body := struct {
+		SessionID string   `json:"session_id" validate:"max=64"`
+		From      *float64 `json:"from" validate:"required,min=0"`
+		To        *float64 `json:"to" validate:"required,min=0"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	if *body.To <= *body.From || *body.To-*body.From > maxHeartbeatSpan {
+		return echo.NewHTTPError(http.StatusBadRequest, "field 'to' has to be greater than 'from' within 60 seconds")
+	}
+
+	videoID := c.Param("id")
+	userID := GetUserID(c)
+
+	var duration float64
+	query := "SELECT v.`duration` FROM videos v JOIN channels c ON c.`id`=v.`channel_id` " +
+		"WHERE v.`id`=? AND " + videoAccessCondition
+	if err := app.db.Get(&duration, query, videoID, userID); err == sql.ErrNoRows {
+		return NotFoundError("video")
+	} else if err != nil {
+		return err
+	}
+
+	if ua := c.Request().UserAgent(); ua != "" && !botPattern.MatchString(ua) {
+		app.playback.add(videoID, viewerKey(c, userID, body.SessionID), duration, *body.From, *body.To, time.Now())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// flushPlayback adds the buffered watch time and retention to the daily
+// statistics of videos.
+func (app *App) flushPlayback() error {
+	watchTime, retention := app.playback.take(time.Now())
+
+	for key, t := range watchTime {
+		query := "INSERT INTO video_stats (`video_id`, `date`, `watch_time`) VALUES (?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE `watch_time`=`watch_time`+VALUES(`watch_time`)"
+		if _, err := app.db.Exec(query, key.videoID, key.date, t); err != nil && !isForeignKeyError(err) {
+			app.playback.restore(watchTime, retention)
+			return err
+		}
+
+		delete(watchTime, key)
+	}
+
+	for key, n := range retention {
+		query := "INSERT INTO video_retention (`video_id`, `date`, `bucket`, `viewers`) VALUES (?, ?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE `viewers`=`viewers`+VALUES(`viewers`)"
+		if _, err := app.db.Exec(query, key.videoID, key.date, key.bucket, n); err != nil && !isForeignKeyError(err) {
+			app.playback.restore(watchTime, retention)
+			return err
+		}
+
+		delete(retention, key)
+	}
+
+	return nil
+}
+
+// recordVideoStat adds the changes of likes, dislikes and comments to the
+// daily statistics of the video.
+func recordVideoStat(db sqlx.Execer, videoID string, at time.Time, likes int, dislikes int, comments int) error {
+	query := "INSERT INTO video_stats (`video_id`, `date`, `likes`, `dislikes`, `comments`) VALUES (?, DATE(?), ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE `likes`=`likes`+VALUES(`likes`), `dislikes`=`dislikes`+VALUES(`dislikes`), " +
+		"`comments`=`comments`+VALUES(`comments`)"
+	_, err := db.Exec(query, videoID, at, likes, dislikes, comments)
+	return err
+}
+
+type VideoStat struct {
+	Date                string  `json:"date" db:"date"`
+	Views               uint64  `json:"views" db:"views"`
+	WatchTime           float64 `json:"watch_time" db:"watch_time"`
+	AverageViewDuration float64 `json:"average_view_duration" db:"-"`
+}
+
+func (s *VideoStat) average() {
+	if s.Views > 0 {
+		s.AverageViewDuration = s.WatchTime / float64(s.Views)
+	}
+}
+
+func (app *App) GetVideoAnalytics(c echo.Context) error {
+	videoID := c.Param("id")
+
+	var ownerID string
+	query := "SELECT c.`owner` FROM videos v JOIN channels c ON v.`channel_id`=c.`id` WHERE v.`id`=?"
+	if err := app.db.Get(&ownerID, query, videoID); err == sql.ErrNoRows {
+		return NotFoundError("video")
+	} else if err != nil {
+		return err
+	}
+
+	if ownerID != GetUserID(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "you don't have permission on this video")
+	}
+
+	from, to, err := parseDateRange(c)
+	if err != nil {
+		return err
+	}
+
+	response := struct {
+		From      string      `json:"from"`
+		To        string      `json:"to"`
+		Total     VideoStat   `json:"total"`
+		Daily     []VideoStat `json:"daily"`
+		Retention []float64   `json:"retention"`
+	}{
+		From:      from.Format(dateLayout),
+		To:        to.Format(dateLayout),
+		Daily:     []VideoStat{},
+		Retention: make([]float64, retentionBuckets),
+	}
+
+	var rows []VideoStat
+	query = "SELECT DATE_FORMAT(`date`, '%Y-%m-%d') `date`, `views`, `watch_time` FROM video_stats " +
+		"WHERE `video_id`=? AND `date` BETWEEN ? AND ? ORDER BY `date`"
+	if err = app.db.Select(&rows, query, videoID, response.From, response.To); err != nil {
+		return err
+	}
+
+	for d, i := from, 0; !d.After(to); d = d.AddDate(0, 0, 1) {
+		stat := VideoStat{Date: d.Format(dateLayout)}
+		if i < len(rows) && rows[i].Date == stat.Date {
+			stat = rows[i]
+			i++
+		}
+
+		stat.average()
+		response.Daily = append(response.Daily, stat)
+		response.Total.Views += stat.Views
+		response.Total.WatchTime += stat.WatchTime
+	}
+	response.Total.average()
+
+	var buckets []struct {
+		Bucket  int    `db:"bucket"`
+		Viewers uint64 `db:"viewers"`
+	}
+	query = "SELECT `bucket`, SUM(`viewers`) `viewers` FROM video_retention " +
+		"WHERE `video_id`=? AND `date` BETWEEN ? AND ? GROUP BY `bucket`"
+	if err = app.db.Select(&buckets, query, videoID, response.From, response.To); err != nil {
+		return err
+	}
+
+	// Retention is the ratio of viewers who reached each 1% of the video.
+	// Viewers whose views are not counted yet are reflected in the base.
+	base := float64(response.Total.Views)
+	for _, b := range buckets {
+		base = math.Max(base, float64(b.Viewers))
+	}
+
+	if base > 0 {
+		for _, b := range buckets {
+			if b.Bucket >= 0 && b.Bucket < retentionBuckets {
+				response.Retention[b.Bucket] = float64(b.Viewers) / base
+			}
+		}
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+type ChannelStat struct {
+	Date              string  `json:"date" db:"date"`
+	Views             uint64  `json:"views" db:"views"`
+	WatchTime         float64 `json:"watch_time" db:"watch_time"`
+	SubscribersGained int64   `json:"subscribers_gained" db:"-"`
+	SubscribersLost   int64   `json:"subscribers_lost" db:"-"`
+	Likes             int64   `json:"likes" db:"likes"`
+	Dislikes          int64   `json:"dislikes" db:"dislikes"`
+	Comments          int64   `json:"comments" db:"comments"`
+}
+
+func (s *ChannelStat) add(o ChannelStat) {
+	s.Views += o.Views
+	s.WatchTime += o.WatchTime
+	s.SubscribersGained += o.SubscribersGained
+	s.SubscribersLost += o.SubscribersLost
+	s.Likes += o.Likes
+	s.Dislikes += o.Dislikes
+	s.Comments += o.Comments
+}
+
+type TopVideo struct {
+	ID                  string  `json:"id" db:"id"`
+	Title               string  `json:"title" db:"title"`
+	Views               uint64  `json:"views" db:"views"`
+	WatchTime           float64 `json:"watch_time" db:"watch_time"`
+	AverageViewDuration float64 `json:"average_view_duration" db:"-"`
+}
+
+// periodStart returns the first day of the period containing the date.
+// Weeks start on Monday.
+func periodStart(d time.Time, granularity string) time.Time {
+	switch granularity {
+	case "week":
+		return d.AddDate(0, 0, -(int(d.Weekday())+6)%7)
+	case "month":
+		return time.Date(d.Year(), d.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return d
+	}
+}
+
+func (app *App) GetChannelAnalytics(c echo.Context) error {
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	from, to, err := parseDateRange(c)
+	if err != nil {
+		return err
+	}
+
+	granularity := c.QueryParam("granularity")
+	if granularity == "" {
+		granularity = "day"
+	} else if granularity != "day" && granularity != "week" && granularity != "month" {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'granularity' has to be day, week or month")
+	}
+
+	format := c.QueryParam("format")
+	if format != "" && format != "json" && format != "csv" {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'format' has to be json or csv")
+	}
+
+	var rows []ChannelStat
+	query := "SELECT DATE_FORMAT(s.`date`, '%Y-%m-%d') `date`, SUM(s.`views`) `views`, SUM(s.`watch_time`) `watch_time`, " +
+		"SUM(s.`likes`) `likes`, SUM(s.`dislikes`) `dislikes`, SUM(s.`comments`) `comments` " +
+		"FROM video_stats s JOIN videos v ON v.`id`=s.`video_id` " +
+		"WHERE v.`channel_id`=? AND s.`date` BETWEEN ? AND ? GROUP BY s.`date` ORDER BY s.`date`"
+	err = app.db.Select(&rows, query, channelID, from.Format(dateLayout), to.Format(dateLayout))
+	if err != nil {
+		return err
+	}
+
+	subscriptions, err := app.SelectSubscriptionStats(channelID, from, to)
+	if err != nil {
+		return err
+	}
+
+	response := struct {
+		From        string        `json:"from"`
+		To          string        `json:"to"`
+		Granularity string        `json:"granularity"`
+		Total       ChannelStat   `json:"total"`
+		Data        []ChannelStat `json:"data"`
+		TopVideos   []TopVideo    `json:"top_videos"`
+	}{
+		From:        from.Format(dateLayout),
+		To:          to.Format(dateLayout),
+		Granularity: granularity,
+		Data:        []ChannelStat{},
+		TopVideos:   []TopVideo{},
+	}
+
+	i := 0
+	for _, sub := range subscriptions {
+		stat := ChannelStat{Date: sub.Date}
+		if i < len(rows) && rows[i].Date == sub.Date {
+			stat = rows[i]
+			i++
+		}
+		stat.SubscribersGained = sub.Gained
+		stat.SubscribersLost = sub.Lost
+
+		// Stats of a period are labeled with its first day in the range.
+		d, _ := time.Parse(dateLayout, stat.Date)
+		if start := periodStart(d, granularity); start.After(from) {
+			stat.Date = start.Format(dateLayout)
+		} else {
+			stat.Date = response.From
+		}
+
+		if n := len(response.Data); n > 0 && response.Data[n-1].Date == stat.Date {
+			response.Data[n-1].add(stat)
+		} else {
+			response.Data = append(response.Data, stat)
+		}
+
+		response.Total.add(stat)
+	}
+	response.Total.Date = response.From
+
+	if format == "csv" {
+		return writeChannelStatsCSV(c, channelID, response.Data)
+	}
+
+	query = "SELECT v.`id`, v.`title`, SUM(s.`views`) `views`, SUM(s.`watch_time`) `watch_time` " +
+		"FROM video_stats s JOIN videos v ON v.`id`=s.`video_id` " +
+		"WHERE v.`channel_id`=? AND s.`date` BETWEEN ? AND ? " +
+		"GROUP BY v.`id` HAVING `views` > 0 OR `watch_time` > 0 ORDER BY `views` DESC, `watch_time` DESC LIMIT 10"
+	err = app.db.Select(&response.TopVideos, query, channelID, response.From, response.To)
+	if err != nil {
+		return err
+	}
+
+	for i := range response.TopVideos {
+		if v := &response.TopVideos[i]; v.Views > 0 {
+			v.AverageViewDuration = v.WatchTime / float64(v.Views)
+		}
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func writeChannelStatsCSV(c echo.Context, channelID string, stats []ChannelStat) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+channelID+`-analytics.csv"`)
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	w.Write([]string{"date", "views", "watch_time", "subscribers_gained", "subscribers_lost", "likes", "dislikes", "comments"})
+	for _, s := range stats {
+		w.Write([]string{
+			s.Date,
+			strconv.FormatUint(s.Views, 10),
+			strconv.FormatFloat(s.WatchTime, 'f', 3, 64),
+			strconv.FormatInt(s.SubscribersGained, 10),
+			strconv.FormatInt(s.SubscribersLost, 10),
+			strconv.FormatInt(s.Likes, 10),
+			strconv.FormatInt(s.Dislikes, 10),
+			strconv.FormatInt(s.Comments, 10),
+		})
+	}
+
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	blurhashX = 4
+	blurhashY = 3
+
+	// blurhashSample is the size of the image the hash is computed from,
+	// which is enough for the few components of a placeholder.
+	blurhashSample = 32
+
+	// colorBits is the number of bits per channel of the histogram which the
+	// dominant color is picked from.
+	colorBits = 4
+
+	base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// placeholder is shown by clients while an image is loading.
+type placeholder struct {
+	blurhash string
+	color    string
+}
+
+func encodeBase83(value int, length int) string {
+	var b strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		b.WriteByte(base83Chars[digit])
+	}
+
+	return b.String()
+}
+
+func sRGBToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v float64, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// dominantColor returns the most common color of img, which is the average
+// of the pixels in the largest bin of a coarse histogram.
+func dominantColor(img *image.NRGBA) string {
+	type bin struct {
+		count   int
+		r, g, b int
+	}
+
+	bins := map[int]*bin{}
+	var top *bin
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			p := img.Pix[y*img.Stride+x*4:]
+			if p[3] < 128 {
+				continue
+			}
+
+			shift := 8 - colorBits
+			key := int(p[0])>>shift<<(2*colorBits) | int(p[1])>>shift<<colorBits | int(p[2])>>shift
+			b, ok := bins[key]
+			if !ok {
+				b = &bin{}
+				bins[key] = b
+			}
+
+			b.count++
+			b.r += int(p[0])
+			b.g += int(p[1])
+			b.b += int(p[2])
+			if top == nil || b.count > top.count {
+				top = b
+			}
+		}
+	}
+
+	if top == nil {
+		return "#000000"
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", top.r/top.count, top.g/top.count, top.b/top.count)
+}
+
+// computePlaceholder computes the blurhash and the dominant color of img.
+func computePlaceholder(img image.Image) placeholder {
+	small := imaging.Fit(img, blurhashSample, blurhashSample, imaging.Box)
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+
+	factors := make([][3]float64, 0, blurhashX*blurhashY)
+	for j := 0; j < blurhashY; j++ {
+		for i := 0; i < blurhashX; i++ {
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := small.Pix[y*small.Stride+x*4:]
+					f[0] += basis * sRGBToLinear(p[0])
+					f[1] += basis * sRGBToLinear(p[1])
+					f[2] += basis * sRGBToLinear(p[2])
+				}
+			}
+
+			scale := 1 / float64(w*h)
+			if i != 0 || j != 0 {
+				scale *= 2
+			}
+
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	dc, ac := factors[0], factors[1:]
+
+	var b strings.Builder
+	b.WriteString(encodeBase83((blurhashX-1)+(blurhashY-1)*9, 1))
+
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		b.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		b.WriteString(encodeBase83(0, 1))
+	}
+
+	r, g, bl := linearToSRGB(dc[0]), linearToSRGB(dc[1]), linearToSRGB(dc[2])
+	b.WriteString(encodeBase83(r<<16+g<<8+bl, 4))
+
+	for _, f := range ac {
+		var q [3]int
+		for k := range q {
+			q[k] = int(math.Max(0, math.Min(18, math.Floor(signPow(f[k]/maxValue, 0.5)*9+9.5))))
+		}
+
+		b.WriteString(encodeBase83(q[0]*19*19+q[1]*19+q[2], 2))
+	}
+
+	return placeholder{
+		blurhash: b.String(),
+		color:    dominantColor(small),
+	}
+}
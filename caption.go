@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	maxCaptionSize = 1 << 20
+	maxCaptionCues = 10000
+)
+
+var (
+	cueTimePattern      = regexp.MustCompile(`^(?:(\d{1,3}):)?([0-5]\d):([0-5]\d)[.,](\d{3})$`)
+	captionBlockPattern = regexp.MustCompile(`\n{2,}`)
+)
+
+type captionCue struct {
+	start    time.Duration
+	end      time.Duration
+	settings string
+	text     string
+}
+
+func parseCueTime(s string) (time.Duration, bool) {
+	m := cueTimePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+
+	h, _ := strconv.Atoi(m[1])
+	min, _ := strconv.Atoi(m[2])
+	sec, _ := strconv.Atoi(m[3])
+	ms, _ := strconv.Atoi(m[4])
+
+	return time.Duration(h)*time.Hour + time.Duration(min)*time.Minute +
+		time.Duration(sec)*time.Second + time.Duration(ms)*time.Millisecond, true
+}
+
+func formatCueTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// parseCaptions parses cues of a caption file in SRT or WebVTT.
+func parseCaptions(data []byte) ([]captionCue, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "caption file has to be encoded in UTF-8")
+	}
+
+	text := strings.ReplaceAll(strings.ReplaceAll(string(data), "\r\n", "\n"), "\r", "\n")
+	blocks := captionBlockPattern.Split(strings.TrimSpace(text), -1)
+
+	vtt := strings.HasPrefix(blocks[0], "WEBVTT")
+	if vtt {
+		// The first block is the header of WebVTT.
+		blocks = blocks[1:]
+	}
+
+	cues := []captionCue{}
+	for _, block := range blocks {
+		lines := strings.Split(block, "\n")
+		if vtt && (strings.HasPrefix(lines[0], "NOTE") || lines[0] == "STYLE" || lines[0] == "REGION") {
+			continue
+		}
+
+		// Both formats may have an identifier line before the timings.
+		if !strings.Contains(lines[0], "-->") && len(lines) > 1 {
+			lines = lines[1:]
+		}
+
+		timings := strings.Fields(lines[0])
+		if len(timings) < 3 || timings[1] != "-->" || (!vtt && len(timings) > 3) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid cue timings: "+lines[0])
+		}
+
+		start, ok1 := parseCueTime(timings[0])
+		end, ok2 := parseCueTime(timings[2])
+		if !ok1 || !ok2 || end <= start {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid cue timings: "+lines[0])
+		}
+
+		cue := captionCue{
+			start:    start,
+			end:      end,
+			settings: strings.Join(timings[3:], " "),
+			text:     strings.TrimSpace(strings.Join(lines[1:], "\n")),
+		}
+		if strings.Contains(cue.text, "-->") {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "cue text can not contain '-->'")
+		}
+
+		cues = append(cues, cue)
+		if len(cues) > maxCaptionCues {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("caption file can not have more than %d cues", maxCaptionCues))
+		}
+	}
+
+	if len(cues) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "caption file has no cues")
+	}
+
+	return cues, nil
+}
+
+// convertCaptions converts a caption file in SRT or WebVTT into WebVTT.
+func convertCaptions(data []byte) ([]byte, error) {
+	cues, err := parseCaptions(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n")
+	for _, cue := range cues {
+		buf.WriteString("\n" + formatCueTime(cue.start) + " --> " + formatCueTime(cue.end))
+		if cue.settings != "" {
+			buf.WriteString(" " + cue.settings)
+		}
+		buf.WriteString("\n" + cue.text + "\n")
+	}
+
+	return buf.Bytes(), nil
+}
+
+type CaptionTrack struct {
+	ID        string    `json:"-" db:"id"`
+	VideoID   string    `json:"-" db:"video_id"`
+	Language  string    `json:"language" db:"language"`
+	Label     string    `json:"label" db:"label"`
+	URL       string    `json:"url" db:"-"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+func captionDir(videoID string, id string) string {
+	return videoID + "/captions/" + id
+}
+
+func (app *App) selectCaptionTracks(videoID string) ([]CaptionTrack, error) {
+	tracks := []CaptionTrack{}
+	query := "SELECT * FROM captions WHERE `video_id`=? ORDER BY `language`"
+	if err := app.db.Unsafe().Select(&tracks, query, videoID); err != nil {
+		return nil, err
+	}
+
+	for i := range tracks {
+		tracks[i].URL = storageURL(&app.Config.Storages.Video, captionDir(videoID, tracks[i].ID)+"/captions.vtt")
+	}
+
+	return tracks, nil
+}
+
+func (app *App) GetVideoCaptions(c echo.Context) error {
+	videoID := c.Param("id")
+
+	var exist bool
+	query := "SELECT 1 FROM videos v JOIN channels c ON c.`id`=v.`channel_id` WHERE v.`id`=? AND " + videoAccessCondition
+	if err := app.db.Get(&exist, query, videoID, GetUserID(c)); err == sql.ErrNoRows {
+		return NotFoundError("video")
+	} else if err != nil {
+		return err
+	}
+
+	tracks, err := app.selectCaptionTracks(videoID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"data": tracks})
+}
+
+func (app *App) checkVideoOwner(videoID string, userID string) error {
+	var owner string
+	query := "SELECT c.`owner` FROM videos v JOIN channels c ON v.`channel_id`=c.`id` WHERE v.`id`=?"
+	if err := app.db.Get(&owner, query, videoID); err == sql.ErrNoRows {
+		return NotFoundError("video")
+	} else if err != nil {
+		return err
+	}
+
+	if owner != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "you don't have permission on this video")
+	}
+
+	return nil
+}
+
+func (app *App) PutVideoCaption(c echo.Context) error {
+	videoID := c.Param("id")
+	language := c.Param("language")
+	if err := app.checkVideoOwner(videoID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	if !languagePattern.MatchString(language) || len(language) > 35 {
+		return echo.NewHTTPError(http.StatusBadRequest, "language has to be a language tag like 'en' or 'ko-KR'")
+	}
+
+	label := strings.TrimSpace(c.FormValue("label"))
+	if label == "" {
+		label = language
+	} else if utf8.RuneCountInString(label) > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "length of 'label' has to be less than or equal to 100")
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return err
+	}
+
+	if header.Size > maxCaptionSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "caption file has to be less than or equal to 1MB")
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	vtt, err := convertCaptions(data)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "caption")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(dir+"/captions.vtt", vtt, 0644); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	track := CaptionTrack{
+		ID:        ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy).String(),
+		VideoID:   videoID,
+		Language:  language,
+		Label:     label,
+		UpdatedAt: now,
+	}
+
+	if err = app.videoStorage.storeFile(dir, captionDir(videoID, track.ID)); err != nil {
+		return err
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		app.videoStorage.removeFiles(captionDir(videoID, track.ID))
+		return err
+	}
+
+	var prevID string
+	query := "SELECT `id` FROM captions WHERE `video_id`=? AND `language`=? FOR UPDATE"
+	if err = tx.Get(&prevID, query, videoID, language); err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		app.videoStorage.removeFiles(captionDir(videoID, track.ID))
+		return err
+	}
+
+	query = "INSERT INTO captions (`id`, `video_id`, `language`, `label`, `updated_at`) VALUES (?, ?, ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE `id`=VALUES(`id`), `label`=VALUES(`label`), `updated_at`=VALUES(`updated_at`)"
+	if _, err = tx.Exec(query, track.ID, videoID, language, label, now); err != nil {
+		tx.Rollback()
+		app.videoStorage.removeFiles(captionDir(videoID, track.ID))
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		app.videoStorage.removeFiles(captionDir(videoID, track.ID))
+		return err
+	}
+
+	// The file of the replaced track is a leftover even if it fails to be removed.
+	if prevID != "" {
+		app.videoStorage.removeFiles(captionDir(videoID, prevID))
+	}
+
+	track.URL = storageURL(&app.Config.Storages.Video, captionDir(videoID, track.ID)+"/captions.vtt")
+	return c.JSON(http.StatusOK, track)
+}
+
+func (app *App) DeleteVideoCaption(c echo.Context) error {
+	videoID := c.Param("id")
+	if err := app.checkVideoOwner(videoID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	var id string
+	query := "SELECT `id` FROM captions WHERE `video_id`=? AND `language`=?"
+	if err := app.db.Get(&id, query, videoID, c.Param("language")); err == sql.ErrNoRows {
+		return NotFoundError("caption")
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := app.db.Exec("DELETE FROM captions WHERE `id`=?", id); err != nil {
+		return err
+	}
+
+	app.videoStorage.removeFiles(captionDir(videoID, id))
+	return c.NoContent(http.StatusNoContent)
+}
@@ -3,14 +3,11 @@ package main
 import (
 	"context"
 	"database/sql"
-	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
@@ -19,14 +16,47 @@ import (
 )
 
 type Channel struct {
-	ID            string     `json:"id" db:"id"`
-	Name          string     `json:"name" db:"name"`
-	Description   string     `json:"description" db:"description"`
-	Picture       *string    `json:"picture" db:"picture"`
-	Subscribers   uint64     `json:"subscribers" db:"subscribers"`
-	Videos        uint64     `json:"videos" db:"videos"`
-	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
-	DeactivatedAt *time.Time `json:"deactivated_at" db:"deactivated_at"`
+	ID              string            `json:"id" db:"id"`
+	Handle          *string           `json:"handle" db:"handle"`
+	Name            string            `json:"name" db:"name"`
+	Description     string            `json:"description" db:"description"`
+	Picture         *string           `json:"picture" db:"picture"`
+	PictureURLs     map[string]string `json:"picture_urls" db:"-"`
+	PictureBlurhash *string           `json:"picture_blurhash" db:"picture_blurhash"`
+	PictureColor    *string           `json:"picture_color" db:"picture_color"`
+	Banner          *string           `json:"banner" db:"banner"`
+	BannerURLs      map[string]string `json:"banner_urls" db:"-"`
+	BannerBlurhash  *string           `json:"banner_blurhash" db:"banner_blurhash"`
+	BannerColor     *string           `json:"banner_color" db:"banner_color"`
+	Subscribers     uint64            `json:"subscribers" db:"subscribers"`
+	Videos          uint64            `json:"videos" db:"videos"`
+	Verified        bool              `json:"verified" db:"verified"`
+	CreatedAt       time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time         `json:"updated_at" db:"updated_at"`
+	DeactivatedAt   *time.Time        `json:"deactivated_at" db:"deactivated_at"`
+}
+
+func (app *App) indexChannel(channel *Channel) error {
+	_, err := app.es.Index().
+		Index(app.Config.Elasticsearch.ChannelIndex).
+		Id(channel.ID).
+		BodyJson(echo.Map{
+			"handle":      channel.Handle,
+			"name":        channel.Name,
+			"description": channel.Description,
+			"verified":    channel.Verified,
+			"updated_at":  channel.UpdatedAt,
+		}).
+		Do(context.Background())
+
+	return err
+}
+
+func (app *App) setChannelURLs(channels []Channel) {
+	for i := range channels {
+		channels[i].PictureURLs = app.imageURLs(channels[i].Picture, app.Config.ChannelPicture)
+		channels[i].BannerURLs = app.imageURLs(channels[i].Banner, app.Config.ChannelBanner)
+	}
 }
 
 func (app *App) SelectChannel(id string) (channel *Channel, err error) {
@@ -41,6 +71,8 @@ func (app *App) SelectChannel(id string) (channel *Channel, err error) {
 
 	if rows.Next() {
 		err = rows.StructScan(&channel)
+		channel.PictureURLs = app.imageURLs(channel.Picture, app.Config.ChannelPicture)
+		channel.BannerURLs = app.imageURLs(channel.Banner, app.Config.ChannelBanner)
 	} else {
 		err = NotFoundError("channel")
 	}
@@ -95,7 +127,9 @@ func (app *App) GetChannels(c echo.Context) error {
 
 		search.Query(elastic.NewBoolQuery().Must(
 			elastic.NewRangeQuery("updated_at").Lte(searchTime),
-			elastic.NewMultiMatchQuery(q, "name^2", "description"),
+			elastic.NewMultiMatchQuery(strings.TrimPrefix(q, "@"), "handle^3", "name^2", "description"),
+		).Should(
+			elastic.NewTermQuery("verified", true).Boost(verifiedBoost),
 		)).
 			Size(limit+1).
 			Sort("_score", false).
@@ -147,6 +181,8 @@ func (app *App) GetChannels(c echo.Context) error {
 	if len(response.Data) > limit {
 		response.Data = response.Data[:limit]
 	}
+
+	app.setChannelURLs(response.Data)
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -197,6 +233,8 @@ func (app *App) GetSubscribedChannels(c echo.Context) error {
 	if len(response.Data) > limit {
 		response.Data = response.Data[:limit]
 	}
+
+	app.setChannelURLs(response.Data)
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -256,15 +294,12 @@ func (app *App) PostChannel(c echo.Context) error {
 		return err
 	}
 
-	_, err = app.es.Index().
-		Index(app.Config.Elasticsearch.ChannelIndex).
-		Id(id.String()).
-		BodyJson(echo.Map{
-			"name":        body.Name,
-			"description": body.Description,
-			"updated_at":  now,
-		}).
-		Do(context.Background())
+	err = app.indexChannel(&Channel{
+		ID:          id.String(),
+		Name:        body.Name,
+		Description: body.Description,
+		UpdatedAt:   now,
+	})
 
 	if err == nil {
 		if err = tx.Commit(); err != nil {
@@ -279,60 +314,49 @@ func (app *App) PostChannel(c echo.Context) error {
 }
 
 func (app *App) PutChannelPicture(c echo.Context) error {
-	channelID := c.Param("id")
-	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
-		return err
-	}
+	return app.putChannelImage(c, "picture", "c", app.Config.ChannelPicture, centerCrop,
+		app.imageLimits(minPictureSide, minPictureSide))
+}
 
-	header, err := c.FormFile("file")
+func (app *App) PutChannelBanner(c echo.Context) error {
+	hint, err := parseCropHint(c)
 	if err != nil {
 		return err
 	}
 
-	file, err := header.Open()
-	if err != nil {
+	return app.putChannelImage(c, "banner", "b", app.Config.ChannelBanner, hint,
+		app.imageLimits(minBannerWidth, minBannerHeight))
+}
+
+// putChannelImage stores an image of a channel into the column. Files are
+// named with the prefix, "c" for pictures and "b" for banners.
+func (app *App) putChannelImage(c echo.Context, column string, prefix string, options []ImageOption, hint cropHint, limits imageLimits) error {
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
 		return err
 	}
-	defer file.Close()
 
-	img, err := imaging.Decode(file)
+	header, err := c.FormFile("file")
 	if err != nil {
 		return err
 	}
 
-	dir, err := ioutil.TempDir("", "picture")
+	img, err := decodeImageFile(header, limits)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(dir)
-
-	for _, o := range app.Config.UserPicture {
-		output, err := os.Create(fmt.Sprintf("%s/%dx%d.jpg", dir, o.Width, o.Height))
-		if err != nil {
-			return err
-		}
-
-		resized := imaging.Fill(img, o.Width, o.Height, imaging.Center, imaging.Lanczos)
-		err = imaging.Encode(output, resized, imaging.JPEG, imaging.JPEGQuality(app.Config.Thumbnail.Quality))
-		if err != nil {
-			output.Close()
-			return err
-		}
-
-		if err = output.Close(); err != nil {
-			return err
-		}
-	}
 
 	now := time.Now()
-	fileName := "c" + channelID + ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy).String()
+	fileName := prefix + channelID + ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy).String()
 
-	if err = app.imageStorage.storeFile(dir, fileName); err != nil {
+	if err = app.storeImageVariants(img, options, hint, fileName); err != nil {
 		return err
 	}
 
-	_, err = app.db.Exec("UPDATE channels SET `picture`=? WHERE `id`=?", fileName, channelID)
-	if err != nil {
+	ph := computePlaceholder(img)
+	query := "UPDATE channels SET `" + column + "`=?, `" + column + "_blurhash`=?, `" + column + "_color`=?, " +
+		"`updated_at`=? WHERE `id`=?"
+	if _, err = app.db.Exec(query, fileName, ph.blurhash, ph.color, now, channelID); err != nil {
 		return err
 	}
 
@@ -367,12 +391,35 @@ func (app *App) GetChannelVideos(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
 	}
 
+	ownerID, err := app.SelectChannelOwnerID(channelID)
+	if err != nil {
+		return err
+	}
+
+	filter, err := parseVideoFilter(c)
+	if err != nil {
+		return err
+	}
+
+	// The owner sees every video which is not deleted, the others see only public ones.
+	condition := "v.`status`='ACTIVE' AND v.`visibility`='PUBLIC'"
+	if userID := GetUserID(c); userID != "" && userID == ownerID {
+		condition = "v.`status`<>'INACTIVE'"
+	}
+
+	filterSQL, args := filter.sql("v")
+	condition += " AND " + filterSQL
+
 	if pageToken == "" {
-		query := "SELECT * FROM videos WHERE `channel_id`=? AND `status`='ACTIVE' ORDER BY `id` DESC LIMIT ?"
-		err = app.db.Unsafe().Select(&response.Data, query, channelID, limit+1)
+		query := "SELECT * FROM videos v WHERE v.`channel_id`=? AND " + condition +
+			" ORDER BY " + postedOrder("v") + " DESC, v.`id` DESC LIMIT ?"
+		args = append(append([]interface{}{channelID}, args...), limit+1)
+		err = app.db.Unsafe().Select(&response.Data, query, args...)
 	} else {
-		query := "SELECT * FROM videos WHERE `channel_id`=? AND `id` < ? AND `status`='ACTIVE' ORDER BY `id` DESC LIMIT ?"
-		err = app.db.Unsafe().Select(&response.Data, query, channelID, pageToken, limit+1)
+		query := "SELECT * FROM videos v WHERE v.`channel_id`=? AND " + postedBefore("v") + " AND " + condition +
+			" ORDER BY " + postedOrder("v") + " DESC, v.`id` DESC LIMIT ?"
+		args = append(append([]interface{}{channelID, pageToken}, args...), limit+1)
+		err = app.db.Unsafe().Select(&response.Data, query, args...)
 	}
 
 	if err != nil {
@@ -384,14 +431,21 @@ func (app *App) GetChannelVideos(c echo.Context) error {
 		response.Data = response.Data[:limit]
 	}
 
+	if err = app.fillVideos(response.Data); err != nil {
+		return err
+	}
+
 	return c.JSON(http.StatusOK, response)
 }
 
+type SubscriptionInfo struct {
+	Subscribed   bool               `json:"subscribed"`
+	Subscribers  uint64             `json:"subscribers"`
+	Notification *NotificationLevel `json:"notification"`
+}
+
 func (app *App) GetSubscription(c echo.Context) error {
-	var response struct {
-		Subscribed  bool   `json:"subscribed"`
-		Subscribers uint64 `json:"subscribers"`
-	}
+	var response SubscriptionInfo
 
 	userId := GetUserID(c)
 	channelId := c.Param("id")
@@ -404,26 +458,50 @@ func (app *App) GetSubscription(c echo.Context) error {
 	query := "SELECT `subscribers` FROM channels WHERE `id`=?"
 	err = tx.Get(&response.Subscribers, query, channelId)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
-	query = "SELECT 1 FROM subscriptions WHERE `user_id`=? AND `channel_id`=?"
-	rows, err := tx.Query(query, userId, channelId)
-	if err != nil {
+	query = "SELECT `notification` FROM subscriptions WHERE `user_id`=? AND `channel_id`=?"
+	err = tx.Get(&response.Notification, query, userId, channelId)
+	if err != nil && err != sql.ErrNoRows {
 		tx.Rollback()
 		return err
 	}
-	response.Subscribed = rows.Next()
-	rows.Close()
+	response.Subscribed = response.Notification != nil
 
 	tx.Commit()
 	return c.JSON(http.StatusOK, response)
 }
 
+// insertSubscription adds a subscription and updates the subscriber counter
+// and the daily stats of the channel in tx.
+func insertSubscription(tx *sqlx.Tx, userID string, channelID string, level NotificationLevel, at time.Time) error {
+	query := "INSERT INTO subscriptions (`user_id`, `channel_id`, `notification`, `subscribed_at`) VALUES (?, ?, ?, ?)"
+	if _, err := tx.Exec(query, userID, channelID, level, at); err != nil {
+		return err
+	}
+
+	query = "UPDATE channels SET `subscribers`=`subscribers`+1 WHERE `id`=?"
+	if _, err := tx.Exec(query, channelID); err != nil {
+		return err
+	}
+
+	return recordSubscriptionStat(tx, channelID, at, 1, 0)
+}
+
 func (app *App) PostSubscription(c echo.Context) error {
-	var response struct {
-		Subscribed  bool   `json:"subscribed"`
-		Subscribers uint64 `json:"subscribers"`
+	body := struct {
+		Notification *NotificationLevel `json:"notification"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	response := SubscriptionInfo{Notification: body.Notification}
+	if response.Notification == nil {
+		response.Notification = new(NotificationLevel)
+		*response.Notification = NotificationAll
 	}
 
 	userId := GetUserID(c)
@@ -434,7 +512,7 @@ func (app *App) PostSubscription(c echo.Context) error {
 		return err
 	}
 
-	if _, err = tx.Exec("INSERT INTO subscriptions VALUES (?, ?)", userId, channelId); err != nil {
+	if err = insertSubscription(tx, userId, channelId, *response.Notification, time.Now()); err != nil {
 		tx.Rollback()
 
 		if v, ok := err.(*mysql.MySQLError); ok && v.Number == 1062 {
@@ -446,19 +524,52 @@ func (app *App) PostSubscription(c echo.Context) error {
 		}
 	}
 
-	query := "UPDATE channels SET `subscribers`=`subscribers`+1 WHERE `id`=?"
-	if _, err = tx.Exec(query, channelId); err != nil {
-		tx.Rollback()
+	if err = tx.Commit(); err != nil {
 		return err
 	}
 
-	if err = tx.Commit(); err != nil {
+	response.Subscribed = true
+	query := "SELECT `subscribers` FROM channels WHERE `id`=?"
+	if err = app.db.Get(&response.Subscribers, query, channelId); err != nil {
 		return err
 	}
 
-	response.Subscribed = true
+	return c.JSON(http.StatusOK, response)
+}
+
+func (app *App) PutSubscription(c echo.Context) error {
+	body := struct {
+		Notification *NotificationLevel `json:"notification" validate:"required"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	response := SubscriptionInfo{Subscribed: true, Notification: body.Notification}
+
+	userId := GetUserID(c)
+	channelId := c.Param("id")
+
+	query := "UPDATE subscriptions SET `notification`=? WHERE `user_id`=? AND `channel_id`=?"
+	if res, err := app.db.Exec(query, *body.Notification, userId, channelId); err != nil {
+		return err
+	} else if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		query = "SELECT 1 FROM subscriptions WHERE `user_id`=? AND `channel_id`=?"
+		var exist bool
+		if err = app.db.Get(&exist, query, userId, channelId); err == sql.ErrNoRows {
+			return NotFoundError("subscription")
+		} else if err != nil {
+			return err
+		}
+	}
+
 	query = "SELECT `subscribers` FROM channels WHERE `id`=?"
-	if err = app.db.Get(&response.Subscribers, query, channelId); err != nil {
+	if err := app.db.Get(&response.Subscribers, query, channelId); err != nil {
 		return err
 	}
 
@@ -466,10 +577,7 @@ func (app *App) PostSubscription(c echo.Context) error {
 }
 
 func (app *App) DeleteSubscription(c echo.Context) error {
-	var response struct {
-		Subscribed  bool   `json:"subscribed"`
-		Subscribers uint64 `json:"subscribers"`
-	}
+	var response SubscriptionInfo
 
 	userId := GetUserID(c)
 	channelId := c.Param("id")
@@ -497,6 +605,11 @@ func (app *App) DeleteSubscription(c echo.Context) error {
 		return err
 	}
 
+	if err = recordSubscriptionStat(tx, channelId, time.Now(), 0, 1); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	if err = tx.Commit(); err != nil {
 		return err
 	}
@@ -510,6 +623,133 @@ func (app *App) DeleteSubscription(c echo.Context) error {
 	return c.JSON(http.StatusOK, response)
 }
 
+func recordSubscriptionStat(tx *sqlx.Tx, channelID string, at time.Time, gained int, lost int) error {
+	query := "INSERT INTO subscription_stats (`channel_id`, `date`, `gained`, `lost`) VALUES (?, DATE(?), ?, ?) " +
+		"ON DUPLICATE KEY UPDATE `gained`=`gained`+VALUES(`gained`), `lost`=`lost`+VALUES(`lost`)"
+	_, err := tx.Exec(query, channelID, at, gained, lost)
+	return err
+}
+
+type Subscriber struct {
+	ID           string    `json:"id" db:"id"`
+	Name         string    `json:"name" db:"name"`
+	Picture      *string   `json:"picture" db:"picture"`
+	SubscribedAt time.Time `json:"subscribed_at" db:"subscribed_at"`
+}
+
+func (app *App) GetChannelSubscribers(c echo.Context) error {
+	response := struct {
+		Pagination *string      `json:"pagination"`
+		Data       []Subscriber `json:"data"`
+	}{Data: []Subscriber{}}
+
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	pageToken := c.QueryParam("pagination")
+	limit := 20
+
+	var err error
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	if pageToken == "" {
+		query := `SELECT u.id, u.name, u.picture, s.subscribed_at
+			FROM subscriptions s JOIN users u ON u.id=s.user_id
+			WHERE s.channel_id=?
+			ORDER BY s.subscribed_at DESC, s.user_id DESC LIMIT ?`
+		err = app.db.Select(&response.Data, query, channelID, limit+1)
+	} else {
+		var page *pagination
+		if page, err = parsePagination(pageToken); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid pagination token")
+		}
+
+		query := `SELECT u.id, u.name, u.picture, s.subscribed_at
+			FROM subscriptions s JOIN users u ON u.id=s.user_id
+			WHERE s.channel_id=? AND (s.subscribed_at < ? OR (s.subscribed_at = ? AND s.user_id < ?))
+			ORDER BY s.subscribed_at DESC, s.user_id DESC LIMIT ?`
+		err = app.db.Select(&response.Data, query,
+			channelID, page.searchTime, page.searchTime, page.id.String(), limit+1)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(response.Data) > limit {
+		last := response.Data[limit-1]
+		if id, err := ulid.Parse(last.ID); err == nil {
+			next := (&pagination{searchTime: last.SubscribedAt, id: id}).tokenize()
+			response.Pagination = &next
+		}
+
+		response.Data = response.Data[:limit]
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+type SubscriptionStat struct {
+	Date   string `json:"date" db:"date"`
+	Gained int64  `json:"gained" db:"gained"`
+	Lost   int64  `json:"lost" db:"lost"`
+	Net    int64  `json:"net" db:"-"`
+}
+
+func (app *App) SelectSubscriptionStats(channelID string, from time.Time, to time.Time) ([]SubscriptionStat, error) {
+	var rows []SubscriptionStat
+	query := "SELECT DATE_FORMAT(`date`, '%Y-%m-%d') `date`, `gained`, `lost` FROM subscription_stats " +
+		"WHERE `channel_id`=? AND `date` BETWEEN ? AND ? ORDER BY `date`"
+	err := app.db.Select(&rows, query, channelID, from.Format(dateLayout), to.Format(dateLayout))
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []SubscriptionStat{}
+	for d, i := from, 0; !d.After(to); d = d.AddDate(0, 0, 1) {
+		stat := SubscriptionStat{Date: d.Format(dateLayout)}
+		if i < len(rows) && rows[i].Date == stat.Date {
+			stat = rows[i]
+			i++
+		}
+
+		stat.Net = stat.Gained - stat.Lost
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+func (app *App) GetChannelSubscriberStats(c echo.Context) error {
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	from, to, err := parseDateRange(c)
+	if err != nil {
+		return err
+	}
+
+	stats, err := app.SelectSubscriptionStats(channelID, from, to)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"data": stats})
+}
+
 func (app *App) SelectChannelOwnerID(channelID string) (string, error) {
 	var ownerID string
 	err := app.db.Get(&ownerID, "SELECT `owner` FROM channels WHERE `id`=?", channelID)
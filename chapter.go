@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	minChapters      = 3
+	maxChapters      = 100
+	minChapterLength = 10
+	maxChapterTitle  = 100
+)
+
+var chapterLinePattern = regexp.MustCompile(`^\s*[\[(]?((?:\d{1,2}:)?\d{1,2}:\d{2})[\])]?\s*(?:[-–—:|]\s*)?(.+?)\s*$`)
+
+type Chapter struct {
+	Start float64 `json:"start" db:"start"`
+	Title string  `json:"title" db:"title"`
+}
+
+func parseChapterTime(s string) float64 {
+	var seconds float64
+	for _, part := range strings.Split(s, ":") {
+		n, _ := strconv.Atoi(part)
+		seconds = seconds*60 + float64(n)
+	}
+
+	return seconds
+}
+
+// parseDescriptionChapters reads chapters from the lines of a description
+// which start with a timestamp like '01:23 Title'.
+func parseDescriptionChapters(description string) []Chapter {
+	chapters := []Chapter{}
+	for _, line := range strings.Split(description, "\n") {
+		if m := chapterLinePattern.FindStringSubmatch(line); m != nil {
+			chapters = append(chapters, Chapter{parseChapterTime(m[1]), m[2]})
+		}
+	}
+
+	return chapters
+}
+
+// validateChapters checks that chapters start from 0 in order, each lasts
+// at least minChapterLength seconds and the last one starts before the end
+// of the video. The duration is not checked before it is known.
+func validateChapters(chapters []Chapter, duration float64) error {
+	if len(chapters) < minChapters || len(chapters) > maxChapters {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("number of chapters has to be %d~%d", minChapters, maxChapters))
+	}
+
+	if chapters[0].Start != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "the first chapter has to start at 0")
+	}
+
+	for i, ch := range chapters {
+		if ch.Title == "" || utf8.RuneCountInString(ch.Title) > maxChapterTitle {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("length of chapter title has to be 1~%d", maxChapterTitle))
+		}
+
+		end := duration
+		if i+1 < len(chapters) {
+			end = chapters[i+1].Start
+		} else if duration <= 0 {
+			continue
+		}
+
+		if end-ch.Start < minChapterLength {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("chapter at %s has to be at least %d seconds long", formatChapterTime(ch.Start), minChapterLength))
+		}
+	}
+
+	return nil
+}
+
+func formatChapterTime(seconds float64) string {
+	s := int(seconds)
+	return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+func (app *App) selectChapters(videoID string) ([]Chapter, error) {
+	chapters := []Chapter{}
+	query := "SELECT `start`, `title` FROM video_chapters WHERE `video_id`=? ORDER BY `start`"
+	if err := app.db.Select(&chapters, query, videoID); err != nil {
+		return nil, err
+	}
+
+	return chapters, nil
+}
+
+func replaceVideoChapters(tx *sqlx.Tx, videoID string, chapters []Chapter) error {
+	if _, err := tx.Exec("DELETE FROM video_chapters WHERE `video_id`=?", videoID); err != nil {
+		return err
+	}
+
+	for _, ch := range chapters {
+		query := "INSERT INTO video_chapters (`video_id`, `start`, `title`) VALUES (?, ?, ?)"
+		if _, err := tx.Exec(query, videoID, ch.Start, ch.Title); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncVideoChapters updates chapters after the description or the duration
+// of a video is changed. Chapters from the description are replaced, while
+// explicit ones are only cut at the end. Either is cleared if invalid.
+func syncVideoChapters(tx *sqlx.Tx, videoID string, description string, duration float64, explicit bool) error {
+	var chapters []Chapter
+	if explicit {
+		if duration <= 0 {
+			return nil
+		}
+
+		query := "SELECT `start`, `title` FROM video_chapters WHERE `video_id`=? AND `start`<? ORDER BY `start`"
+		if err := tx.Select(&chapters, query, videoID, duration); err != nil {
+			return err
+		}
+	} else {
+		chapters = parseDescriptionChapters(description)
+	}
+
+	if validateChapters(chapters, duration) != nil {
+		chapters = nil
+	}
+
+	return replaceVideoChapters(tx, videoID, chapters)
+}
+
+func (app *App) PutVideoChapters(c echo.Context) error {
+	body := struct {
+		Chapters []Chapter `json:"chapters"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	videoID := c.Param("id")
+	if err := app.checkVideoOwner(videoID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	video, err := app.SelectVideo(videoID)
+	if err != nil {
+		return err
+	}
+
+	for i := range body.Chapters {
+		body.Chapters[i].Title = strings.TrimSpace(body.Chapters[i].Title)
+	}
+
+	if err = validateChapters(body.Chapters, float64(video.Duration)); err != nil {
+		return err
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE videos SET `chapters_explicit`=1 WHERE `id`=?", videoID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = replaceVideoChapters(tx, videoID, body.Chapters); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"data": body.Chapters})
+}
+
+// DeleteVideoChapters discards explicit chapters and goes back to the ones
+// from the description.
+func (app *App) DeleteVideoChapters(c echo.Context) error {
+	videoID := c.Param("id")
+	if err := app.checkVideoOwner(videoID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	video, err := app.SelectVideo(videoID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE videos SET `chapters_explicit`=0 WHERE `id`=?", videoID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = syncVideoChapters(tx, videoID, video.Description, float64(video.Duration), false); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	chapters, err := app.selectChapters(videoID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"data": chapters})
+}
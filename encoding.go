@@ -0,0 +1,701 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awebow/ezsock"
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwt"
+	"github.com/oklog/ulid/v2"
+)
+
+type JobStatus int
+
+const (
+	JobUploading JobStatus = iota
+	JobPending
+	JobRunning
+	JobDone
+	JobDead
+)
+
+func (s JobStatus) String() string {
+	switch s {
+	case JobUploading:
+		return "UPLOADING"
+	case JobPending:
+		return "PENDING"
+	case JobRunning:
+		return "RUNNING"
+	case JobDone:
+		return "DONE"
+	case JobDead:
+		return "DEAD"
+	}
+
+	return ""
+}
+
+func parseJobStatus(s string) (JobStatus, error) {
+	switch strings.ToUpper(s) {
+	case "UPLOADING":
+		return JobUploading, nil
+	case "PENDING":
+		return JobPending, nil
+	case "RUNNING":
+		return JobRunning, nil
+	case "DONE":
+		return JobDone, nil
+	case "DEAD":
+		return JobDead, nil
+	}
+
+	return 0, errors.New("invalid value for JobStatus")
+}
+
+func (s JobStatus) Value() (driver.Value, error) {
+	return s.String(), nil
+}
+
+func (s *JobStatus) Scan(src interface{}) (err error) {
+	switch src.(type) {
+	case string:
+		*s, err = parseJobStatus(src.(string))
+	case []byte:
+		*s, err = parseJobStatus(string(src.([]byte)))
+	default:
+		err = errors.New("invalid type for JobStatus")
+	}
+	return
+}
+
+func (s JobStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *JobStatus) UnmarshalJSON(data []byte) error {
+	var str string
+	err := json.Unmarshal(data, &str)
+	if err != nil {
+		return err
+	}
+
+	*s, err = parseJobStatus(str)
+	return err
+}
+
+type EncodingJob struct {
+	ID          string     `json:"id" db:"id"`
+	VideoID     string     `json:"video_id" db:"video_id"`
+	Status      JobStatus  `json:"status" db:"status"`
+	Attempts    int        `json:"attempts" db:"attempts"`
+	Worker      *string    `json:"worker" db:"worker"`
+	Lease       *string    `json:"lease,omitempty" db:"lease"`
+	LeaseUntil  *time.Time `json:"lease_until" db:"lease_until"`
+	Progress    float64    `json:"progress" db:"progress"`
+	Error       *string    `json:"error" db:"error"`
+	AvailableAt time.Time  `json:"available_at" db:"available_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// insertEncodingJob creates a job to encode the video. The job can not be
+// claimed until the upload of the source file completes.
+func (app *App) insertEncodingJob(tx *sqlx.Tx, videoID string, now time.Time) error {
+	id := ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy)
+	query := "INSERT INTO encoding_jobs (`id`, `video_id`, `status`, `available_at`, `created_at`, `updated_at`) " +
+		"VALUES (?, ?, 'UPLOADING', ?, ?, ?)"
+	_, err := tx.Exec(query, id.String(), videoID, now, now, now)
+	return err
+}
+
+// PostVideoUploadComplete queues the encoding job of a video after its source
+// file is uploaded to the encoder, with the token for the video.
+func (app *App) PostVideoUploadComplete(c echo.Context) error {
+	videoID := c.Param("id")
+
+	token, ok := c.Get("uploadToken").(*jwtgo.Token)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+
+	claims := token.Claims.(jwtgo.MapClaims)
+	if id, ok := claims["video_id"].(string); !ok || id != videoID {
+		return echo.ErrUnauthorized
+	}
+
+	now := time.Now()
+	query := "UPDATE encoding_jobs SET `status`='PENDING', `available_at`=?, `updated_at`=? " +
+		"WHERE `video_id`=? AND `status`='UPLOADING'"
+	res, err := app.db.Exec(query, now, now, videoID)
+	if err != nil {
+		return err
+	}
+
+	if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		// The upload may be reported again after the job is queued.
+		var exists bool
+		query := "SELECT EXISTS (SELECT 1 FROM encoding_jobs WHERE `video_id`=?)"
+		if err = app.db.Get(&exists, query, videoID); err != nil {
+			return err
+		} else if !exists {
+			return NotFoundError("job")
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// checkEncoder checks that the request is made by an encoder worker, which
+// has a token signed with the upload sign key and issued by "encoder". Tokens
+// for a single video can not handle jobs.
+func checkEncoder(c echo.Context) error {
+	token, ok := c.Get("uploadToken").(*jwtgo.Token)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+
+	claims := token.Claims.(jwtgo.MapClaims)
+	if _, scoped := claims["video_id"]; scoped || claims["iss"] != "encoder" {
+		return echo.ErrForbidden
+	}
+
+	return nil
+}
+
+func (app *App) leaseDuration() time.Duration {
+	return time.Duration(app.Config.EncodingLease) * time.Second
+}
+
+// PostEncodingJobClaim leases the oldest available job to the worker. The
+// worker has to send heartbeats before the lease expires, or the job goes
+// back to the queue.
+func (app *App) PostEncodingJobClaim(c echo.Context) error {
+	if err := checkEncoder(c); err != nil {
+		return err
+	}
+
+	body := struct {
+		Worker string `json:"worker" validate:"required,max=64"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	lease := ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy).String()
+
+	query := "UPDATE encoding_jobs SET `status`='RUNNING', `worker`=?, `lease`=?, `lease_until`=?, " +
+		"`attempts`=`attempts`+1, `progress`=0, `updated_at`=? " +
+		"WHERE `status`='PENDING' AND `available_at`<=? ORDER BY `available_at`, `id` LIMIT 1"
+	res, err := app.db.Exec(query, body.Worker, lease, now.Add(app.leaseDuration()), now, now)
+	if err != nil {
+		return err
+	}
+
+	if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	var job EncodingJob
+	if err = app.db.Get(&job, "SELECT * FROM encoding_jobs WHERE `lease`=?", lease); err != nil {
+		return err
+	}
+
+	// The worker uses the token to update the video like the encoder did.
+	token := jwt.New()
+	token.Set("video_id", job.VideoID)
+	token.Set(jwt.IssuerKey, "encoder")
+	token.Set(jwt.ExpirationKey, now.Add(24*time.Hour))
+	signed, err := jwt.Sign(token, jwa.HS256, []byte(app.Config.UploadSignKey))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"job": job, "token": string(signed)})
+}
+
+// updateLeasedJob updates the running job only if the lease is still held.
+func (app *App) updateLeasedJob(jobID string, lease string, set string, args ...interface{}) error {
+	query := "UPDATE encoding_jobs SET " + set + " WHERE `id`=? AND `lease`=? AND `status`='RUNNING'"
+	res, err := app.db.Exec(query, append(args, jobID, lease)...)
+	if err != nil {
+		return err
+	}
+
+	if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return echo.NewHTTPError(http.StatusConflict, "the lease of the job is lost")
+	}
+
+	return nil
+}
+
+func (app *App) PostEncodingJobHeartbeat(c echo.Context) error {
+	if err := checkEncoder(c); err != nil {
+		return err
+	}
+
+	body := struct {
+		Lease     string   `json:"lease" validate:"required"`
+		Progress  *float64 `json:"progress" validate:"omitempty,min=0,max=100"`
+		Rendition *string  `json:"rendition" validate:"omitempty,max=32"`
+		ETA       *int     `json:"eta" validate:"omitempty,min=0"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	leaseUntil := now.Add(app.leaseDuration())
+
+	set := "`lease_until`=?, `updated_at`=?"
+	args := []interface{}{leaseUntil, now}
+	if body.Progress != nil {
+		set += ", `progress`=?"
+		args = append(args, *body.Progress)
+	}
+
+	if err := app.updateLeasedJob(c.Param("id"), body.Lease, set, args...); err != nil {
+		return err
+	}
+
+	if body.Progress != nil {
+		var videoID string
+		if err := app.db.Get(&videoID, "SELECT `video_id` FROM encoding_jobs WHERE `id`=?", c.Param("id")); err != nil {
+			return err
+		}
+
+		p := &EncodingProgress{
+			VideoID:   videoID,
+			State:     EncodingProgressing,
+			Percent:   *body.Progress,
+			Rendition: body.Rendition,
+			ETA:       body.ETA,
+			UpdatedAt: now,
+		}
+		if err := app.reportEncoding(p, p); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"lease_until": leaseUntil})
+}
+
+func (app *App) PostEncodingJobComplete(c echo.Context) error {
+	if err := checkEncoder(c); err != nil {
+		return err
+	}
+
+	body := struct {
+		Lease string `json:"lease" validate:"required"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	set := "`status`='DONE', `progress`=100, `lease`=NULL, `lease_until`=NULL, `error`=NULL, `updated_at`=?"
+	if err := app.updateLeasedJob(c.Param("id"), body.Lease, set, time.Now()); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// PostEncodingJobFail gives up the job after a failure. The job is retried
+// later until it reaches the maximum attempts, and then it is dead-lettered.
+// A worker can skip retries of a failure which never succeeds.
+func (app *App) PostEncodingJobFail(c echo.Context) error {
+	if err := checkEncoder(c); err != nil {
+		return err
+	}
+
+	body := struct {
+		Lease string `json:"lease" validate:"required"`
+		Error string `json:"error" validate:"max=1000"`
+		Retry *bool  `json:"retry"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	retry := body.Retry == nil || *body.Retry
+	if err := app.failEncodingJob(c.Param("id"), body.Lease, body.Error, retry); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (app *App) failEncodingJob(jobID string, lease string, reason string, retry bool) error {
+	var job EncodingJob
+	query := "SELECT * FROM encoding_jobs WHERE `id`=? AND `lease`=? AND `status`='RUNNING'"
+	if err := app.db.Get(&job, query, jobID, lease); err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusConflict, "the lease of the job is lost")
+	} else if err != nil {
+		return err
+	}
+
+	return app.failJob(&job, reason, retry)
+}
+
+// failJob gives up the running job. The job is retried later until it reaches
+// the maximum attempts, and then it is dead-lettered.
+func (app *App) failJob(job *EncodingJob, reason string, retry bool) error {
+	now := time.Now()
+
+	status := JobDead
+	if retry && job.Attempts < app.Config.EncodingMaxAttempts {
+		status = JobPending
+	}
+
+	// Retries are delayed longer as the job fails more.
+	availableAt := now.Add(app.leaseDuration() * time.Duration(job.Attempts))
+	set := "`status`=?, `error`=?, `lease`=NULL, `lease_until`=NULL, `available_at`=?, `updated_at`=?"
+	if err := app.updateLeasedJob(job.ID, *job.Lease, set, status, nullIfEmpty(&reason), availableAt, now); err != nil {
+		return err
+	}
+
+	if status != JobDead {
+		return nil
+	}
+
+	// Owners are told only about the failure which is not retried.
+	p := &EncodingProgress{
+		VideoID:   job.VideoID,
+		State:     EncodingFailed,
+		Percent:   job.Progress,
+		Reason:    nullIfEmpty(&reason),
+		UpdatedAt: now,
+	}
+	if err := app.reportEncoding(p, p); err != nil {
+		fmt.Println(err)
+	}
+
+	return nil
+}
+
+// expireEncodingJobs fails jobs whose workers stopped sending heartbeats.
+func (app *App) expireEncodingJobs() error {
+	var jobs []EncodingJob
+	query := "SELECT * FROM encoding_jobs WHERE `status`='RUNNING' AND `lease_until`<?"
+	if err := app.db.Select(&jobs, query, time.Now()); err != nil {
+		return err
+	}
+
+	for i := range jobs {
+		if err := app.failJob(&jobs[i], "lease expired", true); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	return nil
+}
+
+func (app *App) GetEncodingJobs(c echo.Context) error {
+	if err := app.CheckAdmin(GetUserID(c)); err != nil {
+		return err
+	}
+
+	response := struct {
+		Pagination *string       `json:"pagination"`
+		Data       []EncodingJob `json:"data"`
+	}{Data: []EncodingJob{}}
+
+	pageToken := c.QueryParam("pagination")
+	limit := 20
+
+	var err error
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	status := JobDead
+	if q := c.QueryParam("status"); q != "" {
+		if status, err = parseJobStatus(q); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "value of 'status' has to be UPLOADING, PENDING, RUNNING, DONE or DEAD")
+		}
+	}
+
+	query := "SELECT * FROM encoding_jobs WHERE `status`=?"
+	args := []interface{}{status}
+	if pageToken != "" {
+		query += " AND `id` < ?"
+		args = append(args, pageToken)
+	}
+
+	query += " ORDER BY `id` DESC LIMIT ?"
+	if err = app.db.Select(&response.Data, query, append(args, limit+1)...); err != nil {
+		return err
+	}
+
+	if len(response.Data) > limit {
+		response.Pagination = &response.Data[limit-1].ID
+		response.Data = response.Data[:limit]
+	}
+
+	for i := range response.Data {
+		response.Data[i].Lease = nil
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// PostEncodingJobRetry puts a dead job back to the queue with fresh attempts.
+func (app *App) PostEncodingJobRetry(c echo.Context) error {
+	if err := app.CheckAdmin(GetUserID(c)); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	query := "UPDATE encoding_jobs SET `status`='PENDING', `attempts`=0, `available_at`=?, `updated_at`=? " +
+		"WHERE `id`=? AND `status`='DEAD'"
+	res, err := app.db.Exec(query, now, now, c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return NotFoundError("job")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type EncodingState int
+
+const (
+	EncodingProgressing EncodingState = iota
+	EncodingFailed
+	EncodingEncoded
+)
+
+func (s EncodingState) String() string {
+	switch s {
+	case EncodingProgressing:
+		return "PROGRESS"
+	case EncodingFailed:
+		return "FAILED"
+	case EncodingEncoded:
+		return "ENCODED"
+	}
+
+	return ""
+}
+
+func parseEncodingState(s string) (EncodingState, error) {
+	switch strings.ToUpper(s) {
+	case "PROGRESS":
+		return EncodingProgressing, nil
+	case "FAILED":
+		return EncodingFailed, nil
+	case "ENCODED":
+		return EncodingEncoded, nil
+	}
+
+	return 0, errors.New("invalid value for EncodingState")
+}
+
+func (s EncodingState) Value() (driver.Value, error) {
+	return s.String(), nil
+}
+
+func (s *EncodingState) Scan(src interface{}) (err error) {
+	switch src.(type) {
+	case string:
+		*s, err = parseEncodingState(src.(string))
+	case []byte:
+		*s, err = parseEncodingState(string(src.([]byte)))
+	default:
+		err = errors.New("invalid type for EncodingState")
+	}
+	return
+}
+
+func (s EncodingState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *EncodingState) UnmarshalJSON(data []byte) error {
+	var str string
+	err := json.Unmarshal(data, &str)
+	if err != nil {
+		return err
+	}
+
+	*s, err = parseEncodingState(str)
+	return err
+}
+
+// event returns the name of the websocket event for the state.
+func (s EncodingState) event() string {
+	return strings.ToLower(s.String())
+}
+
+// EncodingProgress is the last known state of encoding a video.
+type EncodingProgress struct {
+	VideoID   string        `json:"video_id" db:"video_id"`
+	State     EncodingState `json:"state" db:"state"`
+	Percent   float64       `json:"percent" db:"percent"`
+	Rendition *string       `json:"rendition" db:"rendition"`
+	ETA       *int          `json:"eta" db:"eta"`
+	Reason    *string       `json:"reason" db:"reason"`
+	UpdatedAt time.Time     `json:"updated_at" db:"updated_at"`
+}
+
+func encodeRoom(videoID string) string {
+	return "video/" + videoID + "/encode"
+}
+
+// reportEncoding persists the state of encoding the video and publishes it
+// to the encode room of the video. data is the payload of the event. The
+// state is published even if it fails to be persisted.
+func (app *App) reportEncoding(p *EncodingProgress, data interface{}) error {
+	query := "INSERT INTO encoding_progress (`video_id`, `state`, `percent`, `rendition`, `eta`, `reason`, `updated_at`) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE `state`=VALUES(`state`), `percent`=VALUES(`percent`), " +
+		"`rendition`=VALUES(`rendition`), `eta`=VALUES(`eta`), `reason`=VALUES(`reason`), `updated_at`=VALUES(`updated_at`)"
+	_, err := app.db.Exec(query, p.VideoID, p.State, p.Percent, p.Rendition, p.ETA, p.Reason, p.UpdatedAt)
+
+	if app.ws != nil {
+		app.ws.Publish(encodeRoom(p.VideoID), p.State.event(), data)
+		if p.State == EncodingEncoded {
+			app.ws.UnsubscribeAll(encodeRoom(p.VideoID))
+		}
+	}
+
+	return err
+}
+
+func (app *App) selectEncodingProgress(videoID string) (*EncodingProgress, error) {
+	p := &EncodingProgress{}
+	err := app.db.Get(p, "SELECT * FROM encoding_progress WHERE `video_id`=?", videoID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return p, err
+}
+
+// emitEncodingProgress sends the last known state of encoding the video to
+// a client which joined the room late.
+func (app *App) emitEncodingProgress(client *ezsock.Client, videoID string) {
+	p, err := app.selectEncodingProgress(videoID)
+	if err != nil || p == nil {
+		return
+	}
+
+	if p.State == EncodingEncoded {
+		if video, err := app.SelectVideo(videoID); err == nil {
+			client.Emit(p.State.event(), video)
+		}
+	} else {
+		client.Emit(p.State.event(), p)
+	}
+}
+
+// PutEncodingProgress lets the encoder report the progress or the failure
+// of encoding a video with the token for the video.
+func (app *App) PutEncodingProgress(c echo.Context) error {
+	videoID := c.Param("id")
+
+	token, ok := c.Get("uploadToken").(*jwtgo.Token)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+
+	claims := token.Claims.(jwtgo.MapClaims)
+	if id, ok := claims["video_id"].(string); !ok || id != videoID || claims["iss"] != "encoder" {
+		return echo.ErrUnauthorized
+	}
+
+	body := struct {
+		State     EncodingState `json:"state"`
+		Percent   float64       `json:"percent" validate:"min=0,max=100"`
+		Rendition *string       `json:"rendition" validate:"omitempty,max=32"`
+		ETA       *int          `json:"eta" validate:"omitempty,min=0"`
+		Reason    *string       `json:"reason" validate:"omitempty,max=1000"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	// Videos become encoded only by setting the status of them ACTIVE.
+	if body.State == EncodingEncoded {
+		return echo.NewHTTPError(http.StatusBadRequest, "field 'state' has to be 'PROGRESS' or 'FAILED'")
+	}
+
+	if _, err := app.SelectVideo(videoID); err != nil {
+		return err
+	}
+
+	p := &EncodingProgress{
+		VideoID:   videoID,
+		State:     body.State,
+		Percent:   body.Percent,
+		Rendition: body.Rendition,
+		ETA:       body.ETA,
+		Reason:    body.Reason,
+		UpdatedAt: time.Now(),
+	}
+	if err := app.reportEncoding(p, p); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, p)
+}
+
+func (app *App) GetEncodingProgress(c echo.Context) error {
+	videoID := c.Param("id")
+	if err := app.checkVideoOwner(videoID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	p, err := app.selectEncodingProgress(videoID)
+	if err != nil {
+		return err
+	} else if p == nil {
+		return NotFoundError("encoding progress")
+	}
+
+	return c.JSON(http.StatusOK, p)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	GUID        string `xml:"guid"`
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Description string `xml:"description"`
+	PubDate     string `xml:"pubDate,omitempty"`
+}
+
+// publicURL joins the public URL of the API server and path.
+func (app *App) publicURL(path string) string {
+	return strings.TrimSuffix(app.Config.PublicURL, "/") + path
+}
+
+func (app *App) channelFeedURL(channelID string) string {
+	return app.publicURL("/channels/" + channelID + "/rss")
+}
+
+func (app *App) GetChannelFeed(c echo.Context) error {
+	channel, err := app.SelectChannel(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	var videos []Video
+	query := "SELECT * FROM videos v WHERE v.`channel_id`=? AND v.`status`='ACTIVE' AND v.`visibility`='PUBLIC' " +
+		"ORDER BY " + postedOrder("v") + " DESC, v.`id` DESC LIMIT 20"
+	if err = app.db.Unsafe().Select(&videos, query, channel.ID); err != nil {
+		return err
+	}
+
+	feed := rss{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       channel.Name,
+			Link:        app.publicURL("/channels/" + channel.ID),
+			Description: channel.Description,
+			Items:       make([]rssItem, len(videos)),
+		},
+	}
+
+	for i, v := range videos {
+		feed.Channel.Items[i] = rssItem{
+			GUID:        v.ID,
+			Title:       v.Title,
+			Link:        app.publicURL("/videos/" + v.ID),
+			Description: v.Description,
+		}
+
+		if v.PostedAt != nil {
+			feed.Channel.Items[i].PubDate = v.PostedAt.Format(time.RFC1123Z)
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "application/rss+xml; charset=UTF-8")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Write([]byte(xml.Header))
+	return xml.NewEncoder(c.Response()).Encode(feed)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{1,28}[A-Za-z0-9]$`)
+
+var reservedHandles = map[string]bool{
+	"api": true, "channel": true, "channels": true, "handles": true,
+	"help": true, "login": true, "logout": true, "me": true, "root": true,
+	"settings": true, "staff": true, "support": true, "system": true,
+	"users": true, "videos": true, "www": true,
+}
+
+// reservedHandleWords can not appear anywhere in a handle so that channels
+// can not impersonate the service or its moderators.
+var reservedHandleWords = []string{"admin", "moderator", "mystream", "official"}
+
+var defaultHandleBlocklist = []string{
+	"asshole", "bitch", "cunt", "dick", "fag", "fuck", "nigga", "nigger",
+	"porn", "pussy", "rape", "shit", "slut", "whore",
+}
+
+// handleAllowlist has words which contain a blocked or reserved word but are
+// allowed in handles.
+var handleAllowlist = []string{
+	"badminton", "dickens", "dickinson", "drape", "fagioli", "grape",
+	"rapeseed", "scrape", "scunthorpe", "snigger", "therapist", "trapeze",
+}
+
+// handleLeet removes separators and maps look-alike characters to letters
+// so that blocked words can not be bypassed by splitting them or writing
+// them in leetspeak.
+var handleLeet = strings.NewReplacer(
+	".", "", "_", "", "-", "",
+	"0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b",
+)
+
+// normalizeHandle returns the handle to match blocked words against. Words
+// of the allowlist are replaced with a character which no word contains.
+func normalizeHandle(handle string) string {
+	normalized := handleLeet.Replace(strings.ToLower(handle))
+	for _, word := range handleAllowlist {
+		normalized = strings.ReplaceAll(normalized, word, ".")
+	}
+
+	return normalized
+}
+
+func (app *App) validateHandle(handle string) error {
+	if !handlePattern.MatchString(handle) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"handle has to be 3~30 characters of letters, numbers, '.', '_' or '-' "+
+				"and start and end with a letter or number")
+	}
+
+	if reservedHandles[strings.ToLower(handle)] {
+		return echo.NewHTTPError(http.StatusBadRequest, "the handle is reserved")
+	}
+
+	normalized := normalizeHandle(handle)
+
+	for _, word := range reservedHandleWords {
+		if strings.Contains(normalized, word) {
+			return echo.NewHTTPError(http.StatusBadRequest, "the handle is reserved")
+		}
+	}
+
+	for _, list := range [][]string{defaultHandleBlocklist, app.Config.HandleBlocklist} {
+		for _, word := range list {
+			word = handleLeet.Replace(strings.ToLower(word))
+			if word != "" && strings.Contains(normalized, word) {
+				return echo.NewHTTPError(http.StatusBadRequest, "the handle contains a disallowed word")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (app *App) handleGraceStart() time.Time {
+	return time.Now().Add(-time.Duration(app.Config.HandleGracePeriod) * time.Second)
+}
+
+func (app *App) GetChannelByHandle(c echo.Context) error {
+	handle := strings.TrimPrefix(c.Param("handle"), "@")
+
+	var id string
+	err := app.db.Get(&id, "SELECT `id` FROM channels WHERE `handle`=?", handle)
+	if err == nil {
+		channel, err := app.SelectChannel(id)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, channel)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	query := "SELECT `channel_id` FROM channel_handles WHERE `handle`=? AND `released_at` > ?"
+	err = app.db.Get(&id, query, handle, app.handleGraceStart())
+	if err == sql.ErrNoRows {
+		return NotFoundError("channel")
+	} else if err != nil {
+		return err
+	}
+
+	return c.Redirect(http.StatusFound, "/channels/"+id)
+}
+
+func (app *App) PutChannelHandle(c echo.Context) error {
+	body := struct {
+		Handle string `json:"handle" validate:"required"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	body.Handle = strings.TrimPrefix(body.Handle, "@")
+	if err := app.validateHandle(body.Handle); err != nil {
+		return err
+	}
+
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var holder string
+	query := "SELECT `channel_id` FROM channel_handles WHERE `handle`=? AND `released_at` > ? FOR UPDATE"
+	err = tx.Get(&holder, query, body.Handle, app.handleGraceStart())
+	if err == nil && holder != channelID {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusConflict, "the handle was recently used by another channel")
+	} else if err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+
+	var current *string
+	if err = tx.Get(&current, "SELECT `handle` FROM channels WHERE `id`=? FOR UPDATE", channelID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	now := time.Now()
+	if current != nil && !strings.EqualFold(*current, body.Handle) {
+		query = "INSERT INTO channel_handles (`handle`, `channel_id`, `released_at`) VALUES (?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE `channel_id`=VALUES(`channel_id`), `released_at`=VALUES(`released_at`)"
+		if _, err = tx.Exec(query, *current, channelID, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// The badge is reviewed again so that verified channels can not take
+	// handles of other creators.
+	revoked := false
+	if current == nil || !strings.EqualFold(*current, body.Handle) {
+		note := "the handle is changed"
+		if revoked, err = revokeVerification(tx, channelID, nil, &note, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	query = "UPDATE channels SET `handle`=?, `updated_at`=? WHERE `id`=?"
+	if _, err = tx.Exec(query, body.Handle, now, channelID); err != nil {
+		tx.Rollback()
+
+		if v, ok := err.(*mysql.MySQLError); ok && v.Number == 1062 {
+			return echo.NewHTTPError(http.StatusConflict, "the handle is already taken")
+		}
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM channel_handles WHERE `handle`=?", body.Handle); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	channel, err := app.SelectChannel(channelID)
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		err = app.indexChannelVerification(channelID)
+	} else {
+		err = app.indexChannel(channel)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, channel)
+}
+
+func (app *App) GetChannelHandles(c echo.Context) error {
+	var response struct {
+		Handle  *string `json:"handle"`
+		History []struct {
+			Handle     string    `json:"handle" db:"handle"`
+			ReleasedAt time.Time `json:"released_at" db:"released_at"`
+			Reserved   bool      `json:"reserved" db:"reserved"`
+		} `json:"history"`
+	}
+
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	if err := app.db.Get(&response.Handle, "SELECT `handle` FROM channels WHERE `id`=?", channelID); err != nil {
+		return err
+	}
+
+	query := "SELECT `handle`, `released_at`, `released_at` > ? reserved FROM channel_handles " +
+		"WHERE `channel_id`=? ORDER BY `released_at` DESC"
+	if err := app.db.Select(&response.History, query, app.handleGraceStart(), channelID); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
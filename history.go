@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// completedRatio is the ratio of a video after which watching it again
+// starts from the beginning.
+const completedRatio = 0.95
+
+type progressKey struct {
+	userID  string
+	videoID string
+}
+
+type progressEntry struct {
+	position float64
+	at       time.Time
+}
+
+// progressBuffer keeps the latest positions reported by players until they
+// are flushed into the watch history.
+type progressBuffer struct {
+	mu      sync.Mutex
+	entries map[progressKey]progressEntry
+}
+
+func newProgressBuffer() *progressBuffer {
+	return &progressBuffer{entries: map[progressKey]progressEntry{}}
+}
+
+func (pb *progressBuffer) add(key progressKey, position float64, at time.Time) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	pb.entries[key] = progressEntry{position, at}
+}
+
+func (pb *progressBuffer) get(key progressKey) (progressEntry, bool) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	e, ok := pb.entries[key]
+	return e, ok
+}
+
+// remove forgets the buffered positions of the user, of every video if
+// videoID is empty.
+func (pb *progressBuffer) remove(userID string, videoID string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	for key := range pb.entries {
+		if key.userID == userID && (videoID == "" || key.videoID == videoID) {
+			delete(pb.entries, key)
+		}
+	}
+}
+
+func (pb *progressBuffer) take() map[progressKey]progressEntry {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	entries := pb.entries
+	pb.entries = map[progressKey]progressEntry{}
+	return entries
+}
+
+// restore puts back positions which failed to be flushed unless newer ones
+// are reported meanwhile.
+func (pb *progressBuffer) restore(entries map[progressKey]progressEntry) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	for key, e := range entries {
+		if _, ok := pb.entries[key]; !ok {
+			pb.entries[key] = e
+		}
+	}
+}
+
+func (app *App) PutVideoProgress(c echo.Context) error {
+	body := struct {
+		Position *float64 `json:"position" validate:"required,min=0"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	videoID := c.Param("id")
+	userID := GetUserID(c)
+
+	var duration float64
+	query := "SELECT v.`duration` FROM videos v JOIN channels c ON c.`id`=v.`channel_id` " +
+		"WHERE v.`id`=? AND " + videoAccessCondition
+	if err := app.db.Get(&duration, query, videoID, userID); err == sql.ErrNoRows {
+		return NotFoundError("video")
+	} else if err != nil {
+		return err
+	}
+
+	if duration > 0 && *body.Position > duration {
+		*body.Position = duration
+	}
+
+	// Players report the position continuously, so only the latest one is
+	// written into the history when the buffer is flushed.
+	app.progress.add(progressKey{userID, videoID}, *body.Position, time.Now())
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// flushProgress writes the buffered positions into the watch history of
+// users who do not pause it.
+func (app *App) flushProgress() error {
+	entries := app.progress.take()
+
+	for key, e := range entries {
+		query := "INSERT INTO watch_history (`user_id`, `video_id`, `position`, `watched_at`) " +
+			"SELECT `id`, ?, ?, ? FROM users WHERE `id`=? AND `history_paused`=0 " +
+			"ON DUPLICATE KEY UPDATE `position`=VALUES(`position`), `watched_at`=VALUES(`watched_at`)"
+		if _, err := app.db.Exec(query, key.videoID, e.position, e.at, key.userID); err != nil && !isForeignKeyError(err) {
+			app.progress.restore(entries)
+			return err
+		}
+
+		delete(entries, key)
+	}
+
+	return nil
+}
+
+// selectResumePosition returns the position from which the user continues
+// watching the video.
+func (app *App) selectResumePosition(video *Video, userID string) (*float64, error) {
+	var position float64
+	if e, ok := app.progress.get(progressKey{userID, video.ID}); ok {
+		position = e.position
+	} else {
+		query := "SELECT `position` FROM watch_history WHERE `user_id`=? AND `video_id`=?"
+		if err := app.db.Get(&position, query, userID, video.ID); err == sql.ErrNoRows {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if video.Duration > 0 && position >= float64(video.Duration)*completedRatio {
+		position = 0
+	}
+
+	return &position, nil
+}
+
+func (app *App) GetHistory(c echo.Context) error {
+	return app.listSavedVideos(c, "watch_history s", "watched_at", "1=1")
+}
+
+func (app *App) DeleteHistory(c echo.Context) error {
+	userID := GetUserID(c)
+	app.progress.remove(userID, "")
+	if _, err := app.db.Exec("DELETE FROM watch_history WHERE `user_id`=?", userID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (app *App) DeleteHistoryVideo(c echo.Context) error {
+	userID := GetUserID(c)
+	videoID := c.Param("video_id")
+	_, buffered := app.progress.get(progressKey{userID, videoID})
+	app.progress.remove(userID, videoID)
+
+	query := "DELETE FROM watch_history WHERE `user_id`=? AND `video_id`=?"
+	res, err := app.db.Exec(query, userID, videoID)
+	if err != nil {
+		return err
+	}
+
+	if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 && !buffered {
+		return NotFoundError("video")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+type HistorySettings struct {
+	Paused bool `json:"paused" db:"history_paused"`
+}
+
+func (app *App) GetHistorySettings(c echo.Context) error {
+	var settings HistorySettings
+	if err := app.db.Get(&settings, "SELECT `history_paused` FROM users WHERE `id`=?", GetUserID(c)); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+func (app *App) PutHistorySettings(c echo.Context) error {
+	body := struct {
+		Paused *bool `json:"paused" validate:"required"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	if _, err := app.db.Exec("UPDATE users SET `history_paused`=? WHERE `id`=?", *body.Paused, GetUserID(c)); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, HistorySettings{*body.Paused})
+}
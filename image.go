@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	_ "golang.org/x/image/webp"
+)
+
+// Minimum dimensions of uploaded images by their purpose.
+const (
+	minPictureSide     = 98
+	minBannerWidth     = 1024
+	minBannerHeight    = 576
+	minThumbnailWidth  = 640
+	minThumbnailHeight = 360
+)
+
+// imageFormOverhead is the room for the other fields of a multipart form in
+// the limit of the request body which uploads an image.
+const imageFormOverhead = 1 << 20
+
+var allowedImageFormats = map[string]bool{"jpeg": true, "png": true, "gif": true, "webp": true}
+
+// imageBodyLimit limits the request body which uploads n images, so that
+// larger uploads are rejected before they are read.
+func (app *App) imageBodyLimit(n int64) echo.MiddlewareFunc {
+	return middleware.BodyLimit(fmt.Sprintf("%dB", n*app.Config.ImageUpload.MaxSize+imageFormOverhead))
+}
+
+// imageLimits are the limits of an uploaded image. The size and the pixel
+// count come from the configuration and the minimum dimensions from the
+// purpose of the image.
+type imageLimits struct {
+	maxSize   int64
+	maxPixels int64
+	minWidth  int
+	minHeight int
+}
+
+func (app *App) imageLimits(minWidth int, minHeight int) imageLimits {
+	return imageLimits{
+		maxSize:   app.Config.ImageUpload.MaxSize,
+		maxPixels: app.Config.ImageUpload.MaxPixels,
+		minWidth:  minWidth,
+		minHeight: minHeight,
+	}
+}
+
+// decodeImage decodes an uploaded image within the limits. The header of
+// the image is checked before decoding so that an image which is small in
+// bytes but huge in pixels is rejected without allocating its pixels.
+func decodeImage(r io.Reader, limits imageLimits) (image.Image, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, limits.maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limits.maxSize {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("image file has to be less than or equal to %d bytes", limits.maxSize))
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == image.ErrFormat || (err == nil && !allowedImageFormats[format]) {
+		return nil, echo.NewHTTPError(http.StatusUnsupportedMediaType, "image has to be in JPEG, PNG, GIF or WebP")
+	} else if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid image file")
+	}
+
+	if int64(cfg.Width)*int64(cfg.Height) > limits.maxPixels {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("image can not have more than %d pixels", limits.maxPixels))
+	}
+
+	// The minimum dimensions are checked after the orientation is corrected.
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid image file")
+	}
+
+	if b := img.Bounds(); b.Dx() < limits.minWidth || b.Dy() < limits.minHeight {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("image has to be at least %dx%d", limits.minWidth, limits.minHeight))
+	}
+
+	return img, nil
+}
+
+// decodeImageFile decodes an uploaded image file within the limits.
+func decodeImageFile(header *multipart.FileHeader, limits imageLimits) (image.Image, error) {
+	if header.Size > limits.maxSize {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("image file has to be less than or equal to %d bytes", limits.maxSize))
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decodeImage(file, limits)
+}
+
+type ImageOption struct {
+	Width   int  `json:"width"`
+	Height  int  `json:"height"`
+	Quality int  `json:"quality"`
+	Fit     bool `json:"fit,omitempty"`
+}
+
+func (o ImageOption) Name() string {
+	return fmt.Sprintf("%dx%d", o.Width, o.Height)
+}
+
+// cropHint is a focal point relative to the size of the source image.
+// Both X and Y are in range of 0~1 and the center is (0.5, 0.5).
+type cropHint struct {
+	X float64
+	Y float64
+}
+
+var centerCrop = cropHint{0.5, 0.5}
+
+func parseCropHint(c echo.Context) (cropHint, error) {
+	hint := centerCrop
+
+	for _, f := range []struct {
+		name string
+		dst  *float64
+	}{{"focus_x", &hint.X}, {"focus_y", &hint.Y}} {
+		if v := c.FormValue(f.name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || n < 0 || n > 1 {
+				return hint, echo.NewHTTPError(http.StatusBadRequest, "value of '"+f.name+"' has to be 0~1")
+			}
+
+			*f.dst = n
+		}
+	}
+
+	return hint, nil
+}
+
+// fillFocus scales img to cover width x height and crops the overflow
+// keeping the focal point of hint as close to the center as possible.
+func fillFocus(img image.Image, width, height int, hint cropHint) *image.NRGBA {
+	bounds := img.Bounds()
+	scale := math.Max(float64(width)/float64(bounds.Dx()), float64(height)/float64(bounds.Dy()))
+
+	w := int(math.Ceil(float64(bounds.Dx()) * scale))
+	h := int(math.Ceil(float64(bounds.Dy()) * scale))
+	resized := imaging.Resize(img, w, h, imaging.Lanczos)
+
+	x := int(hint.X*float64(w)) - width/2
+	y := int(hint.Y*float64(h)) - height/2
+	x = int(math.Max(0, math.Min(float64(x), float64(w-width))))
+	y = int(math.Max(0, math.Min(float64(y), float64(h-height))))
+
+	return imaging.Crop(resized, image.Rect(x, y, x+width, y+height))
+}
+
+// render resizes img to the size of the option.
+func (o ImageOption) render(img image.Image, hint cropHint) image.Image {
+	if o.Fit {
+		return imaging.Fit(img, o.Width, o.Height, imaging.Lanczos)
+	}
+
+	return fillFocus(img, o.Width, o.Height, hint)
+}
+
+// storeImageVariants stores every variant of options into the image storage
+// under the directory named key.
+func (app *App) storeImageVariants(img image.Image, options []ImageOption, hint cropHint, key string) error {
+	dir, err := ioutil.TempDir("", "picture")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, o := range options {
+		output, err := os.Create(fmt.Sprintf("%s/%s.jpg", dir, o.Name()))
+		if err != nil {
+			return err
+		}
+
+		err = imaging.Encode(output, o.render(img, hint), imaging.JPEG, imaging.JPEGQuality(o.Quality))
+		if err != nil {
+			output.Close()
+			return err
+		}
+
+		if err = output.Close(); err != nil {
+			return err
+		}
+	}
+
+	return app.imageStorage.storeFile(dir, key)
+}
+
+// storageURL joins the public URL of a storage and the path of a stored file.
+func storageURL(cfg *storageConfig, path string) string {
+	if cfg.URL == "" {
+		return path
+	}
+
+	return strings.TrimSuffix(cfg.URL, "/") + "/" + path
+}
+
+func (app *App) imageURLs(key *string, options []ImageOption) map[string]string {
+	if key == nil {
+		return nil
+	}
+
+	urls := make(map[string]string, len(options))
+	for _, o := range options {
+		urls[o.Name()] = storageURL(&app.Config.Storages.Image, *key+"/"+o.Name()+".jpg")
+	}
+
+	return urls
+}
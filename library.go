@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+type SavedVideo struct {
+	Video
+	SavedAt time.Time `json:"saved_at" db:"saved_at"`
+}
+
+// listSavedVideos lists the videos of source saved by the user from the
+// latest. source is a table aliased as s which has `user_id`, `video_id`
+// and timeColumn, and condition narrows its rows.
+func (app *App) listSavedVideos(c echo.Context, source string, timeColumn string, condition string) error {
+	response := struct {
+		Pagination *string      `json:"pagination"`
+		Data       []SavedVideo `json:"data"`
+	}{Data: []SavedVideo{}}
+
+	userID := GetUserID(c)
+	pageToken := c.QueryParam("pagination")
+	limit := 20
+
+	var err error
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	query := "SELECT v.*, s.`" + timeColumn + "` saved_at FROM " + source + " " +
+		"JOIN videos v ON v.`id`=s.`video_id` JOIN channels c ON c.`id`=v.`channel_id` " +
+		"WHERE s.`user_id`=? AND " + condition + " AND " + videoAccessCondition
+	order := " ORDER BY s.`" + timeColumn + "` DESC, s.`video_id` DESC LIMIT ?"
+
+	if pageToken == "" {
+		err = app.db.Unsafe().Select(&response.Data, query+order, userID, userID, limit+1)
+	} else {
+		var page *pagination
+		if page, err = parsePagination(pageToken); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid pagination token")
+		}
+
+		query += " AND (s.`" + timeColumn + "` < ? OR (s.`" + timeColumn + "` = ? AND s.`video_id` < ?))"
+		err = app.db.Unsafe().Select(&response.Data, query+order,
+			userID, userID, page.searchTime, page.searchTime, page.id.String(), limit+1)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(response.Data) > limit {
+		last := response.Data[limit-1]
+		if id, err := ulid.Parse(last.ID); err == nil {
+			next := (&pagination{searchTime: last.SavedAt, id: id}).tokenize()
+			response.Pagination = &next
+		}
+
+		response.Data = response.Data[:limit]
+	}
+
+	videos := make([]Video, len(response.Data))
+	for i := range response.Data {
+		videos[i] = response.Data[i].Video
+	}
+
+	if err = app.fillVideos(videos); err != nil {
+		return err
+	}
+
+	for i := range videos {
+		response.Data[i].Video = videos[i]
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (app *App) GetWatchLater(c echo.Context) error {
+	return app.listSavedVideos(c, "watch_later s", "added_at", "1=1")
+}
+
+func (app *App) GetLikedVideos(c echo.Context) error {
+	return app.listSavedVideos(c, "expressions s", "expressed_at", "s.`type`='LIKE'")
+}
+
+func (app *App) PutWatchLater(c echo.Context) error {
+	videoID := c.Param("video_id")
+	userID := GetUserID(c)
+
+	var exist bool
+	query := "SELECT 1 FROM videos v JOIN channels c ON c.`id`=v.`channel_id` WHERE v.`id`=? AND " + videoAccessCondition
+	if err := app.db.Get(&exist, query, videoID, userID); err == sql.ErrNoRows {
+		return NotFoundError("video")
+	} else if err != nil {
+		return err
+	}
+
+	query = "INSERT IGNORE INTO watch_later (`user_id`, `video_id`, `added_at`) VALUES (?, ?, ?)"
+	if _, err := app.db.Exec(query, userID, videoID, time.Now()); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (app *App) DeleteWatchLater(c echo.Context) error {
+	query := "DELETE FROM watch_later WHERE `user_id`=? AND `video_id`=?"
+	res, err := app.db.Exec(query, GetUserID(c), c.Param("video_id"))
+	if err != nil {
+		return err
+	}
+
+	if rows, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return NotFoundError("video")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/awebow/ezsock"
@@ -42,6 +46,7 @@ func main() {
 		ContextKey: "uploadToken",
 	})
 	allowUnauth := app.AuthUserMiddleware(true)
+	imageBody := app.imageBodyLimit(1)
 
 	e.GET("/", func(c echo.Context) error {
 		return c.String(http.StatusOK, "Hello, World!")
@@ -52,8 +57,19 @@ func main() {
 	e.POST("/users", app.PostUser)
 	e.POST("/users/tokens", app.PostToken)
 	e.GET("/channels/:id", app.GetChannel)
-	e.GET("/channels/:id/videos", app.GetChannelVideos)
+	e.GET("/channels/handles/:handle", app.GetChannelByHandle)
+	e.GET("/channels/:id/videos", app.GetChannelVideos, allowUnauth)
+	e.GET("/channels/:id/rss", app.GetChannelFeed)
+	e.GET("/channels/:id/home", app.GetChannelHome)
+	e.GET("/channels/:id/sections", app.GetChannelSections)
+	e.GET("/channels/:id/posts", app.GetChannelPosts)
+	e.GET("/posts/:id", app.GetPost)
+	e.GET("/posts/:id/comments", app.GetPostComments)
+	e.GET("/posts/:id/poll", app.GetPoll, allowUnauth)
+	e.GET("/playlists/:id", app.GetPlaylist, allowUnauth)
+	e.GET("/channels/:id/playlists", app.GetChannelPlaylists, allowUnauth)
 	e.GET("/videos", app.GetVideos, allowUnauth)
+	e.GET("/categories", app.GetCategories)
 	e.PUT("/videos/:id", app.PutVideo, func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			userErr := userAuth(func(echo.Context) error { return nil })(c)
@@ -67,19 +83,69 @@ func main() {
 		}
 	})
 	e.GET("/videos/:id", app.GetVideo, allowUnauth)
+	e.POST("/encoder/jobs/claim", app.PostEncodingJobClaim, uploadAuth)
+	e.POST("/encoder/jobs/:id/heartbeat", app.PostEncodingJobHeartbeat, uploadAuth)
+	e.POST("/encoder/jobs/:id/complete", app.PostEncodingJobComplete, uploadAuth)
+	e.POST("/encoder/jobs/:id/fail", app.PostEncodingJobFail, uploadAuth)
+	e.GET("/encoder/jobs", app.GetEncodingJobs, userAuth)
+	e.POST("/encoder/jobs/:id/retry", app.PostEncodingJobRetry, userAuth)
 	e.GET("/videos/:id/comments", app.GetVideoComments, allowUnauth)
 
 	e.GET("/channels", app.GetChannels)
 	e.GET("/channels/subscribed", app.GetSubscribedChannels, userAuth)
 	e.POST("/channels", app.PostChannel, userAuth)
 	e.GET("/channels/:id/permissions", app.GetChannelPermission, userAuth)
-	e.PUT("/channels/:id/picture", app.PutChannelPicture, userAuth)
+	e.PUT("/channels/:id/picture", app.PutChannelPicture, imageBody, userAuth)
+	e.PUT("/channels/:id/banner", app.PutChannelBanner, imageBody, userAuth)
+	e.PUT("/channels/:id/sections", app.PutChannelSections, userAuth)
+	e.GET("/channels/:id/trash", app.GetChannelTrash, userAuth)
+	e.POST("/channels/:id/posts", app.PostChannelPost, imageBody, userAuth)
+	e.PUT("/posts/:id", app.PutPost, userAuth)
+	e.DELETE("/posts/:id", app.DeletePost, userAuth)
+	e.PUT("/posts/:id/poll/vote", app.PutPollVote, userAuth)
+	e.DELETE("/posts/:id/poll/vote", app.DeletePollVote, userAuth)
+	e.GET("/posts/:id/poll/results", app.GetPollResults, userAuth)
+	e.GET("/channels/:id/handles", app.GetChannelHandles, userAuth)
+	e.GET("/channels/:id/verification", app.GetChannelVerification, userAuth)
+	e.POST("/channels/:id/verification", app.PostChannelVerification, userAuth)
+	e.DELETE("/channels/:id/verification", app.DeleteChannelVerification, userAuth)
+	e.GET("/verifications", app.GetVerificationRequests, userAuth)
+	e.PUT("/verifications/:id", app.PutVerificationRequest, userAuth)
+	e.PUT("/channels/:id/handle", app.PutChannelHandle, userAuth)
+	e.GET("/channels/:id/subscribers", app.GetChannelSubscribers, userAuth)
+	e.GET("/channels/:id/subscribers/stats", app.GetChannelSubscriberStats, userAuth)
+	e.GET("/channels/:id/analytics", app.GetChannelAnalytics, userAuth)
 	e.GET("/channels/:id/subscriptions", app.GetSubscription, userAuth)
 	e.POST("/channels/:id/subscriptions", app.PostSubscription, userAuth)
+	e.PUT("/channels/:id/subscriptions", app.PutSubscription, userAuth)
 	e.DELETE("/channels/:id/subscriptions", app.DeleteSubscription, userAuth)
 	e.POST("/videos", app.PostVideo, userAuth)
+	e.PUT("/categories/:id", app.PutCategory, userAuth)
+	e.POST("/playlists", app.PostPlaylist, userAuth)
+	e.PUT("/playlists/:id", app.PutPlaylist, userAuth)
+	e.DELETE("/playlists/:id", app.DeletePlaylist, userAuth)
+	e.POST("/playlists/:id/items", app.PostPlaylistItem, userAuth)
+	e.PUT("/playlists/:id/items/:item_id", app.PutPlaylistItem, userAuth)
+	e.DELETE("/playlists/:id/items/:item_id", app.DeletePlaylistItem, userAuth)
 	e.DELETE("/videos/:id", app.DeleteVideo, userAuth)
-	e.PUT("/videos/:id/thumbnail", app.PutThumbnail, userAuth)
+	e.POST("/videos/:id/restore", app.PostVideoRestore, userAuth)
+	e.PUT("/videos/:id/progress", app.PutVideoProgress, userAuth)
+	e.GET("/videos/:id/captions", app.GetVideoCaptions, allowUnauth)
+	e.PUT("/videos/:id/captions/:language", app.PutVideoCaption, userAuth)
+	e.DELETE("/videos/:id/captions/:language", app.DeleteVideoCaption, userAuth)
+	e.PUT("/videos/:id/chapters", app.PutVideoChapters, userAuth)
+	e.DELETE("/videos/:id/chapters", app.DeleteVideoChapters, userAuth)
+	e.POST("/videos/:id/views", app.PostVideoView, allowUnauth)
+	e.POST("/videos/:id/heartbeats", app.PostVideoHeartbeat, allowUnauth)
+	e.GET("/videos/:id/analytics", app.GetVideoAnalytics, userAuth)
+	e.PUT("/videos/:id/thumbnail", app.PutThumbnail, imageBody, userAuth)
+	e.GET("/videos/:id/thumbnails/candidates", app.GetThumbnailCandidates, userAuth)
+	e.POST("/videos/:id/thumbnails/candidates", app.PostThumbnailCandidates,
+		app.imageBodyLimit(maxThumbnailCandidates), uploadAuth)
+	e.POST("/thumbnails/legacy", app.PostLegacyThumbnails, userAuth)
+	e.GET("/videos/:id/encoding", app.GetEncodingProgress, userAuth)
+	e.PUT("/videos/:id/encoding", app.PutEncodingProgress, uploadAuth)
+	e.POST("/videos/:id/upload/complete", app.PostVideoUploadComplete, uploadAuth)
 	e.GET("/videos/:id/expressions", app.GetExpression, allowUnauth)
 	e.PUT("/videos/:id/expressions", app.PutExpression, userAuth)
 	e.DELETE("/videos/:id/expressions", app.DeleteExpression, userAuth)
@@ -90,7 +156,22 @@ func main() {
 	me.GET("", app.GetMe)
 	me.PUT("", app.PutMe)
 	me.GET("/channels", app.GetMyChannels)
-	me.PUT("/picture", app.PutUserPicture)
+	me.GET("/feed", app.GetFeed)
+	me.GET("/playlists", app.GetMyPlaylists)
+	me.GET("/watch-later", app.GetWatchLater)
+	me.PUT("/watch-later/:video_id", app.PutWatchLater)
+	me.DELETE("/watch-later/:video_id", app.DeleteWatchLater)
+	me.GET("/liked", app.GetLikedVideos)
+	me.GET("/history", app.GetHistory)
+	me.DELETE("/history", app.DeleteHistory)
+	me.DELETE("/history/videos/:video_id", app.DeleteHistoryVideo)
+	me.GET("/history/settings", app.GetHistorySettings)
+	me.PUT("/history/settings", app.PutHistorySettings)
+	me.GET("/subscriptions/export", app.GetSubscriptionExport)
+	me.POST("/subscriptions/import", app.PostSubscriptionImport)
+	me.PUT("/picture", app.PutUserPicture, imageBody)
+	me.GET("/notifications", app.GetNotifications)
+	me.PUT("/notifications/:id", app.PutNotification)
 
 	e.HTTPErrorHandler = app.ErrorHandler
 	InitValidTrans(e)
@@ -99,14 +180,34 @@ func main() {
 		e.GET("/ws", app.ServeWebsocket)
 	}
 
+	go app.RunScheduler()
+
+	go func() {
+		if err := e.Start(app.Config.Listen); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
 	fmt.Println("MyStream API started on " + app.Config.Listen)
-	e.Logger.Fatal(e.Start(app.Config.Listen))
+
+	// Views, playback and progress buffered in memory are flushed before exiting.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		fmt.Println(err)
+	}
+
+	app.flushBuffers()
 }
 
 type App struct {
 	Config struct {
-		Listen   string `json:"listen,omitempty"`
-		Database struct {
+		Listen    string `json:"listen,omitempty"`
+		PublicURL string `json:"public_url"`
+		Database  struct {
 			Host     string `json:"host"`
 			User     string `json:"user"`
 			Password string `json:"password"`
@@ -129,15 +230,32 @@ type App struct {
 			Video storageConfig `json:"video"`
 			Image storageConfig `json:"image"`
 		} `json:"storages"`
-		Thumbnail      ImageOption   `json:"thumbnail"`
+		Thumbnail        ImageOption         `json:"thumbnail"`
+		Thumbnails       []ImageOption       `json:"thumbnails"`
+		ThumbnailFormats []string            `json:"thumbnail_formats"`
+		ImageEncoders    map[string][]string `json:"image_encoders"`
+		ImageUpload      struct {
+			MaxSize   int64 `json:"max_size"`
+			MaxPixels int64 `json:"max_pixels"`
+		} `json:"image_upload"`
 		UserPicture    []ImageOption `json:"user_picture"`
 		ChannelPicture []ImageOption `json:"channel_picture"`
+		ChannelBanner  []ImageOption `json:"channel_banner"`
+		PostImage      []ImageOption `json:"post_image"`
 		Websocket      struct {
 			Enabled      bool `json:"enabled"`
 			PingInterval int  `json:"ping_interval"`
 			PongTimeout  int  `json:"pong_timeout"`
 		} `json:"websocket"`
-		SubscriptionBonus int64 `json:"subscription_bonus"`
+		SubscriptionBonus   int64    `json:"subscription_bonus"`
+		HandleGracePeriod   int64    `json:"handle_grace_period"`
+		HandleBlocklist     []string `json:"handle_blocklist"`
+		SchedulerInterval   int64    `json:"scheduler_interval"`
+		VideoRetention      int64    `json:"video_retention"`
+		ViewThreshold       int64    `json:"view_threshold"`
+		ViewWindow          int64    `json:"view_window"`
+		EncodingLease       int64    `json:"encoding_lease"`
+		EncodingMaxAttempts int      `json:"encoding_max_attempts"`
 	}
 	db           *sqlx.DB
 	es           *elastic.Client
@@ -145,6 +263,9 @@ type App struct {
 	videoStorage storage
 	imageStorage storage
 	ulidEntropy  ulid.MonotonicReader
+	views        *viewCounter
+	playback     *playbackAggregator
+	progress     *progressBuffer
 }
 
 func NewApp() *App {
@@ -157,6 +278,38 @@ func NewApp() *App {
 		app.Config.Listen = ":80"
 	}
 
+	if app.Config.HandleGracePeriod == 0 {
+		app.Config.HandleGracePeriod = 14 * 24 * 60 * 60
+	}
+
+	if app.Config.SchedulerInterval == 0 {
+		app.Config.SchedulerInterval = 30
+	}
+
+	if app.Config.VideoRetention == 0 {
+		app.Config.VideoRetention = 30 * 24 * 60 * 60
+	}
+
+	if app.Config.ViewThreshold == 0 {
+		app.Config.ViewThreshold = 30
+	}
+
+	if app.Config.ViewWindow == 0 {
+		app.Config.ViewWindow = 6 * 60 * 60
+	}
+
+	if app.Config.EncodingLease == 0 {
+		app.Config.EncodingLease = 60
+	}
+
+	if app.Config.EncodingMaxAttempts == 0 {
+		app.Config.EncodingMaxAttempts = 3
+	}
+
+	app.views = newViewCounter(time.Duration(app.Config.ViewWindow) * time.Second)
+	app.playback = newPlaybackAggregator(time.Duration(app.Config.ViewWindow) * time.Second)
+	app.progress = newProgressBuffer()
+
 	db, err := sqlx.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true",
 		app.Config.Database.User,
 		app.Config.Database.Password,
@@ -202,13 +355,30 @@ func NewApp() *App {
 		panic("Can not create image storage")
 	}
 
+	if app.Config.ImageUpload.MaxSize == 0 {
+		app.Config.ImageUpload.MaxSize = 20 << 20
+	}
+
+	if app.Config.ImageUpload.MaxPixels == 0 {
+		app.Config.ImageUpload.MaxPixels = 40000000
+	}
+
+	// The single thumbnail option remains for old configurations.
+	if len(app.Config.Thumbnails) == 0 {
+		app.Config.Thumbnails = []ImageOption{app.Config.Thumbnail}
+	}
+
+	if len(app.Config.ThumbnailFormats) == 0 {
+		app.Config.ThumbnailFormats = []string{"jpeg"}
+	}
+
+	for _, format := range app.Config.ThumbnailFormats {
+		if format != "jpeg" && len(app.Config.ImageEncoders[format]) == 0 {
+			panic("No image encoder for thumbnail format " + format)
+		}
+	}
+
 	app.ulidEntropy = NewSyncMonotonicReader(time.Now().UnixNano())
 
 	return app
 }
-
-type ImageOption struct {
-	Width   int `json:"width"`
-	Height  int `json:"height"`
-	Quality int `json:"quality"`
-}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
 	"testing"
+	"time"
 
+	"github.com/disintegration/imaging"
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -10,3 +18,147 @@ func TestPassword(t *testing.T) {
 	salted := hashPassword("testpa$sW0rd")
 	assert.True(t, verifyPassword("testpa$sW0rd", salted))
 }
+
+func TestValidateHandle(t *testing.T) {
+	app := &App{}
+	app.Config.HandleBlocklist = []string{"spam"}
+
+	assert.NoError(t, app.validateHandle("live.stream_01"))
+	assert.Error(t, app.validateHandle("ab"))
+	assert.Error(t, app.validateHandle("_leading"))
+	assert.Error(t, app.validateHandle("Admin"))
+	assert.Error(t, app.validateHandle("sh1t-channel"))
+	assert.Error(t, app.validateHandle("5pam.channel"))
+	for _, handle := range []string{"FuckYou", "fuckyou", "shitposter", "niggerlover", "porn69", "my_dicks"} {
+		assert.Error(t, app.validateHandle(handle))
+	}
+	for _, handle := range []string{"my.stream_01", "mystream_official", "MyStreamSupport", "the.admins"} {
+		assert.Error(t, app.validateHandle(handle))
+	}
+	for _, handle := range []string{"therapist", "scunthorpe", "dickens", "fagioli", "badminton.club"} {
+		assert.NoError(t, app.validateHandle(handle))
+	}
+	assert.Error(t, app.validateHandle("scunthorpe.fuck"))
+}
+
+func TestViewCounter(t *testing.T) {
+	vc := newViewCounter(time.Hour)
+	now := time.Now()
+
+	assert.True(t, vc.add("video", "user:a", "1.2.3.4", now))
+	assert.False(t, vc.add("video", "user:a", "1.2.3.4", now.Add(time.Minute)))
+	assert.True(t, vc.add("other", "user:a", "1.2.3.4", now))
+	assert.Equal(t, map[string]uint64{"video": 1, "other": 1}, vc.take(now))
+
+	for i := 1; i < maxViewsPerIP; i++ {
+		assert.True(t, vc.add("video", "session:"+string(rune('a'+i)), "1.2.3.4", now))
+	}
+	assert.False(t, vc.add("video", "session:z", "1.2.3.4", now))
+
+	assert.True(t, vc.add("video", "user:a", "1.2.3.4", now.Add(time.Hour)))
+	assert.Equal(t, map[string]uint64{"video": maxViewsPerIP}, vc.take(now.Add(time.Hour)))
+}
+
+func TestPlaybackAggregator(t *testing.T) {
+	pa := newPlaybackAggregator(time.Hour)
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	key := videoDate{"video", "2021-01-01"}
+
+	pa.add("video", "user:a", 200, 0, 10, now)
+	pa.add("video", "user:b", 200, 1, 2, now)
+	// Repeated heartbeats count only the time passed since the last one.
+	pa.add("video", "user:a", 200, 0, 60, now)
+	pa.add("video", "user:a", 200, 0, 60, now.Add(5*time.Second))
+	pa.add("video", "user:a", 200, 190, 250, now.Add(time.Minute))
+
+	expected := map[retentionKey]uint64{{key, 0}: 2}
+	for b := 1; b < 30; b++ {
+		expected[retentionKey{key, b}] = 1
+	}
+	for b := 95; b < retentionBuckets; b++ {
+		expected[retentionKey{key, b}] = 1
+	}
+
+	watchTime, retention := pa.take(now.Add(time.Minute))
+	assert.Equal(t, map[videoDate]float64{key: 10 + 1 + 5 + 10}, watchTime)
+	assert.Equal(t, expected, retention)
+
+	pa.add("video", "user:a", 200, 0, 60, now.Add(2*time.Minute))
+	watchTime, retention = pa.take(now.Add(2 * time.Minute))
+	assert.Equal(t, map[videoDate]float64{key: 60}, watchTime)
+	assert.Empty(t, retention)
+}
+
+func TestConvertCaptions(t *testing.T) {
+	srt := "\xef\xbb\xbf1\r\n00:00:01,000 --> 00:00:02,500\r\nHello\r\nworld\r\n\r\n2\r\n00:01:00,000 --> 01:00:00,000\r\nBye\r\n"
+	vtt, err := convertCaptions([]byte(srt))
+	assert.NoError(t, err)
+	assert.Equal(t, "WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHello\nworld\n\n00:01:00.000 --> 01:00:00.000\nBye\n", string(vtt))
+
+	vtt, err = convertCaptions([]byte("WEBVTT\n\nNOTE comment\n\nintro\n00:05.000 --> 00:06.000 align:start\nHi\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "WEBVTT\n\n00:00:05.000 --> 00:00:06.000 align:start\nHi\n", string(vtt))
+
+	_, err = convertCaptions([]byte("1\n00:00:02,000 --> 00:00:01,000\nBackwards\n"))
+	assert.Error(t, err)
+	_, err = convertCaptions([]byte("WEBVTT\n"))
+	assert.Error(t, err)
+	_, err = convertCaptions([]byte("1\n00:00:01,000 --> 00:00:02,000\n\xff\n"))
+	assert.Error(t, err)
+}
+
+func TestDescriptionChapters(t *testing.T) {
+	chapters := parseDescriptionChapters("Intro text\n00:00 Intro\n[1:05] - Setup\n1:02:03 Wrap up\nnot 2:00 a chapter")
+	assert.Equal(t, []Chapter{{0, "Intro"}, {65, "Setup"}, {3723, "Wrap up"}}, chapters)
+	assert.NoError(t, validateChapters(chapters, 4000))
+	assert.Error(t, validateChapters(chapters, 3730))
+	assert.Error(t, validateChapters(chapters[1:], 0))
+	assert.Error(t, validateChapters([]Chapter{{0, "A"}, {5, "B"}, {30, "C"}}, 0))
+}
+
+func TestPlaceholder(t *testing.T) {
+	img := imaging.New(40, 20, color.NRGBA{255, 0, 0, 255})
+	ph := computePlaceholder(img)
+
+	assert.Equal(t, "#ff0000", ph.color)
+	assert.Len(t, ph.blurhash, 4+2*blurhashX*blurhashY)
+	assert.Equal(t, "L", ph.blurhash[:1])
+	assert.Equal(t, encodeBase83(0xff0000, 4), ph.blurhash[2:6])
+
+	// The dominant color is not muddied by the other colors as the average.
+	img = imaging.New(40, 40, color.NRGBA{0, 0, 255, 255})
+	img = imaging.Paste(img, imaging.New(40, 15, color.NRGBA{255, 255, 0, 255}), image.Pt(0, 0))
+	assert.Equal(t, "#0000ff", computePlaceholder(img).color)
+}
+
+func TestDecodeImage(t *testing.T) {
+	limits := imageLimits{maxSize: 1 << 20, maxPixels: 1000000, minWidth: 16, minHeight: 16}
+	status := func(err error) int {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code
+		}
+		return 0
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, imaging.New(32, 16, color.NRGBA{0, 0, 255, 255})))
+	img, err := decodeImage(bytes.NewReader(buf.Bytes()), limits)
+	assert.NoError(t, err)
+	assert.Equal(t, 32, img.Bounds().Dx())
+
+	limits.minHeight = 32
+	_, err = decodeImage(bytes.NewReader(buf.Bytes()), limits)
+	assert.Equal(t, http.StatusBadRequest, status(err))
+
+	// A GIF header declaring 65535x65535 pixels is rejected before decoding.
+	bomb := []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00")
+	_, err = decodeImage(bytes.NewReader(bomb), limits)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status(err))
+
+	_, err = decodeImage(bytes.NewReader([]byte("not an image")), limits)
+	assert.Equal(t, http.StatusUnsupportedMediaType, status(err))
+
+	limits.maxSize = 64
+	_, err = decodeImage(bytes.NewReader(buf.Bytes()), limits)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status(err))
+}
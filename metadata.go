@@ -0,0 +1,298 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/olivere/elastic/v7"
+)
+
+const (
+	maxVideoTags  = 15
+	maxTagLength  = 30
+	maxTagsLength = 500
+)
+
+type ContentRating int
+
+const (
+	RatingGeneral ContentRating = iota
+	RatingTeen
+	RatingMature
+)
+
+func (r ContentRating) String() string {
+	switch r {
+	case RatingGeneral:
+		return "GENERAL"
+	case RatingTeen:
+		return "TEEN"
+	case RatingMature:
+		return "MATURE"
+	}
+
+	return ""
+}
+
+func parseContentRating(s string) (ContentRating, error) {
+	switch strings.ToUpper(s) {
+	case "GENERAL":
+		return RatingGeneral, nil
+	case "TEEN":
+		return RatingTeen, nil
+	case "MATURE":
+		return RatingMature, nil
+	}
+
+	return 0, errors.New("invalid value for ContentRating")
+}
+
+func (r ContentRating) Value() (driver.Value, error) {
+	return r.String(), nil
+}
+
+func (r *ContentRating) Scan(src interface{}) (err error) {
+	switch src.(type) {
+	case string:
+		*r, err = parseContentRating(src.(string))
+	case []byte:
+		*r, err = parseContentRating(string(src.([]byte)))
+	default:
+		err = errors.New("invalid type for ContentRating")
+	}
+	return
+}
+
+func (r ContentRating) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *ContentRating) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	*r, err = parseContentRating(s)
+	return err
+}
+
+// ratingsUpTo returns every rating which is not stricter than r.
+func ratingsUpTo(r ContentRating) []string {
+	ratings := []string{}
+	for i := RatingGeneral; i <= r; i++ {
+		ratings = append(ratings, i.String())
+	}
+
+	return ratings
+}
+
+var tagSpaces = regexp.MustCompile(`\s+`)
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// normalizeTags lowercases tags, removes their leading '#' and extra spaces
+// and drops empty or duplicated ones keeping the order.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	seen := map[string]bool{}
+	length := 0
+
+	for _, t := range tags {
+		t = strings.TrimLeft(strings.TrimSpace(t), "#")
+		t = strings.ToLower(tagSpaces.ReplaceAllString(strings.TrimSpace(t), " "))
+		if t == "" || seen[t] {
+			continue
+		}
+
+		if len([]rune(t)) > maxTagLength {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "a tag can't be longer than 30 characters")
+		}
+
+		seen[t] = true
+		length += len([]rune(t))
+		normalized = append(normalized, t)
+	}
+
+	if len(normalized) > maxVideoTags {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "a video can't have more than 15 tags")
+	}
+
+	if length > maxTagsLength {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "tags can't be longer than 500 characters in total")
+	}
+
+	return normalized, nil
+}
+
+// replaceVideoTags replaces the tags of the video with normalized tags.
+func replaceVideoTags(tx *sqlx.Tx, videoID string, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM video_tags WHERE `video_id`=?", videoID); err != nil {
+		return err
+	}
+
+	for i, tag := range tags {
+		query := "INSERT INTO video_tags (`video_id`, `position`, `tag`) VALUES (?, ?, ?)"
+		if _, err := tx.Exec(query, videoID, i, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateVideoMetadata checks the category and the language of a video.
+func (app *App) validateVideoMetadata(categoryID *string, language *string) error {
+	if categoryID != nil && *categoryID != "" {
+		var exist bool
+		if err := app.db.Get(&exist, "SELECT 1 FROM categories WHERE `id`=?", *categoryID); err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid value of 'category_id'")
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if language != nil && *language != "" && !languagePattern.MatchString(*language) {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'language' has to be a language tag like 'en' or 'ko-KR'")
+	}
+
+	return nil
+}
+
+// videoFilter is a set of conditions on video metadata given by query parameters.
+type videoFilter struct {
+	tag        string
+	categoryID string
+	language   string
+	ratings    []string
+}
+
+func parseVideoFilter(c echo.Context) (*videoFilter, error) {
+	f := &videoFilter{
+		tag:        strings.ToLower(strings.TrimSpace(strings.TrimLeft(c.QueryParam("tag"), "#"))),
+		categoryID: c.QueryParam("category"),
+		language:   c.QueryParam("language"),
+	}
+
+	if q := c.QueryParam("max_rating"); q != "" {
+		rating, err := parseContentRating(q)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "value of 'max_rating' has to be 'GENERAL', 'TEEN' or 'MATURE'")
+		}
+
+		f.ratings = ratingsUpTo(rating)
+	}
+
+	return f, nil
+}
+
+// sql returns the conditions on the videos table aliased as alias.
+func (f *videoFilter) sql(alias string) (string, []interface{}) {
+	conds := []string{}
+	args := []interface{}{}
+
+	if f.tag != "" {
+		conds = append(conds, "EXISTS (SELECT 1 FROM video_tags t WHERE t.video_id="+alias+".id AND t.tag=?)")
+		args = append(args, f.tag)
+	}
+
+	if f.categoryID != "" {
+		conds = append(conds, alias+".category_id=?")
+		args = append(args, f.categoryID)
+	}
+
+	if f.language != "" {
+		conds = append(conds, alias+".language=?")
+		args = append(args, f.language)
+	}
+
+	if len(f.ratings) > 0 {
+		conds = append(conds, alias+".content_rating IN (?"+strings.Repeat(",?", len(f.ratings)-1)+")")
+		for _, r := range f.ratings {
+			args = append(args, r)
+		}
+	}
+
+	if len(conds) == 0 {
+		return "1=1", args
+	}
+
+	return strings.Join(conds, " AND "), args
+}
+
+func (f *videoFilter) esQueries() []elastic.Query {
+	queries := []elastic.Query{}
+
+	if f.tag != "" {
+		queries = append(queries, elastic.NewTermQuery("tags", f.tag))
+	}
+
+	if f.categoryID != "" {
+		queries = append(queries, elastic.NewTermQuery("category_id", f.categoryID))
+	}
+
+	if f.language != "" {
+		queries = append(queries, elastic.NewTermQuery("language", f.language))
+	}
+
+	if len(f.ratings) > 0 {
+		values := make([]interface{}, len(f.ratings))
+		for i, r := range f.ratings {
+			values[i] = r
+		}
+		queries = append(queries, elastic.NewTermsQuery("content_rating", values...))
+	}
+
+	return queries
+}
+
+type Category struct {
+	ID   string `json:"id" db:"id"`
+	Name string `json:"name" db:"name"`
+}
+
+func (app *App) GetCategories(c echo.Context) error {
+	categories := []Category{}
+	if err := app.db.Select(&categories, "SELECT `id`, `name` FROM categories ORDER BY `id`"); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"data": categories})
+}
+
+var categoryIDPattern = regexp.MustCompile(`^[a-z0-9_]{1,30}$`)
+
+func (app *App) PutCategory(c echo.Context) error {
+	body := struct {
+		Name string `json:"name" validate:"required,max=50"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	if err := app.CheckAdmin(GetUserID(c)); err != nil {
+		return err
+	}
+
+	category := Category{c.Param("id"), body.Name}
+	if !categoryIDPattern.MatchString(category.ID) {
+		return echo.NewHTTPError(http.StatusBadRequest, "ID of a category can contain only a-z, 0-9 and _ up to 30 characters")
+	}
+
+	query := "INSERT INTO categories (`id`, `name`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `name`=?"
+	if _, err := app.db.Exec(query, category.ID, category.Name, category.Name); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, category)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+type NotificationLevel int
+
+const (
+	NotificationAll NotificationLevel = iota
+	NotificationPersonalized
+	NotificationNone
+)
+
+func (n NotificationLevel) String() string {
+	switch n {
+	case NotificationAll:
+		return "ALL"
+	case NotificationPersonalized:
+		return "PERSONALIZED"
+	case NotificationNone:
+		return "NONE"
+	}
+
+	return ""
+}
+
+func parseNotificationLevel(s string) (NotificationLevel, error) {
+	switch strings.ToUpper(s) {
+	case "ALL":
+		return NotificationAll, nil
+	case "PERSONALIZED":
+		return NotificationPersonalized, nil
+	case "NONE":
+		return NotificationNone, nil
+	}
+
+	return 0, errors.New("invalid value for NotificationLevel")
+}
+
+func (n NotificationLevel) Value() (driver.Value, error) {
+	return n.String(), nil
+}
+
+func (n *NotificationLevel) Scan(src interface{}) (err error) {
+	switch src.(type) {
+	case string:
+		*n, err = parseNotificationLevel(src.(string))
+	case []byte:
+		*n, err = parseNotificationLevel(string(src.([]byte)))
+	default:
+		err = errors.New("invalid type for NotificationLevel")
+	}
+	return
+}
+
+func (n NotificationLevel) MarshalJSON() ([]byte, error) {
+	return json.Marshal(n.String())
+}
+
+func (n *NotificationLevel) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	*n, err = parseNotificationLevel(s)
+	return err
+}
+
+type Notification struct {
+	ID        string     `json:"id" db:"id"`
+	UserID    string     `json:"-" db:"user_id"`
+	Type      string     `json:"type" db:"type"`
+	ChannelID string     `json:"channel_id" db:"channel_id"`
+	VideoID   *string    `json:"video_id" db:"video_id"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	ReadAt    *time.Time `json:"read_at" db:"read_at"`
+}
+
+// notifyNewVideo creates a notification of video for every subscriber who
+// wants it and pushes it to the subscriber's websocket room.
+//
+// Subscribers with NotificationPersonalized are notified only when they have
+// liked any video of the channel before.
+func (app *App) notifyNewVideo(video *Video) error {
+	var userIDs []string
+	query := `SELECT s.user_id FROM subscriptions s
+		WHERE s.channel_id=? AND (s.notification='ALL' OR (s.notification='PERSONALIZED' AND EXISTS (
+			SELECT 1 FROM expressions e JOIN videos v ON v.id=e.video_id
+			WHERE e.user_id=s.user_id AND v.channel_id=s.channel_id AND e.type='LIKE')))`
+	if err := app.db.Select(&userIDs, query, video.ChannelID); err != nil {
+		return err
+	}
+
+	stmt, err := app.db.Preparex("INSERT IGNORE INTO notifications " +
+		"(`id`, `user_id`, `type`, `channel_id`, `video_id`, `created_at`) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, userID := range userIDs {
+		now := time.Now()
+		n := Notification{
+			ID:        ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy).String(),
+			UserID:    userID,
+			Type:      "VIDEO",
+			ChannelID: video.ChannelID,
+			VideoID:   &video.ID,
+			CreatedAt: now,
+		}
+
+		res, err := stmt.Exec(n.ID, n.UserID, n.Type, n.ChannelID, n.VideoID, n.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		if rows, err := res.RowsAffected(); err == nil && rows > 0 && app.ws != nil {
+			app.ws.Publish(notificationRoom(userID), "notification", n)
+		}
+	}
+
+	return nil
+}
+
+func (app *App) GetNotifications(c echo.Context) error {
+	response := struct {
+		Pagination *string        `json:"pagination"`
+		Data       []Notification `json:"data"`
+	}{Data: []Notification{}}
+
+	pageToken := c.QueryParam("pagination")
+	limit := 20
+
+	var err error
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	if pageToken == "" {
+		query := "SELECT * FROM notifications WHERE `user_id`=? ORDER BY `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&response.Data, query, GetUserID(c), limit+1)
+	} else {
+		query := "SELECT * FROM notifications WHERE `user_id`=? AND `id` < ? ORDER BY `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&response.Data, query, GetUserID(c), pageToken, limit+1)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(response.Data) > limit {
+		response.Pagination = &response.Data[limit-1].ID
+		response.Data = response.Data[:limit]
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (app *App) PutNotification(c echo.Context) error {
+	body := struct {
+		Read bool `json:"read"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+
+	var readAt *time.Time
+	if body.Read {
+		now := time.Now()
+		readAt = &now
+	}
+
+	query := "UPDATE notifications SET `read_at`=IF(? IS NULL, NULL, IFNULL(`read_at`, ?)) " +
+		"WHERE `id`=? AND `user_id`=?"
+	if _, err := app.db.Exec(query, readAt, readAt, c.Param("id"), GetUserID(c)); err != nil {
+		return err
+	}
+
+	n := Notification{}
+	query = "SELECT * FROM notifications WHERE `id`=? AND `user_id`=?"
+	if err := app.db.Unsafe().Get(&n, query, c.Param("id"), GetUserID(c)); err != nil {
+		if err == sql.ErrNoRows {
+			return NotFoundError("notification")
+		}
+		return err
+	}
+
+	return c.JSON(http.StatusOK, n)
+}
+
+func notificationRoom(userID string) string {
+	return fmt.Sprintf("user/%s", userID)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"time"
 
 	"github.com/oklog/ulid/v2"
@@ -32,6 +33,10 @@ func parsePagination(token string) (*pagination, error) {
 		return nil, err
 	}
 
+	if len(data) != 32 {
+		return nil, errors.New("invalid pagination token")
+	}
+
 	buf := bytes.NewBuffer(data)
 
 	var nano int64
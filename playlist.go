@@ -0,0 +1,618 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+const maxPlaylistItems = 5000
+
+type Playlist struct {
+	ID          string     `json:"id" db:"id"`
+	OwnerID     string     `json:"owner_id" db:"owner_id"`
+	ChannelID   *string    `json:"channel_id" db:"channel_id"`
+	Title       string     `json:"title" db:"title"`
+	Description string     `json:"description" db:"description"`
+	Visibility  Visibility `json:"visibility" db:"visibility"`
+	ItemCount   int        `json:"item_count" db:"item_count"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+type PlaylistItem struct {
+	ID         string    `json:"id" db:"id"`
+	PlaylistID string    `json:"playlist_id" db:"playlist_id"`
+	VideoID    string    `json:"video_id" db:"video_id"`
+	Position   int       `json:"position" db:"position"`
+	AddedAt    time.Time `json:"added_at" db:"added_at"`
+	Video      *Video    `json:"video" db:"-"`
+}
+
+func (app *App) SelectPlaylist(id string) (p *Playlist, err error) {
+	p = &Playlist{}
+	err = app.db.Unsafe().Get(p, "SELECT * FROM playlists WHERE `id`=?", id)
+	if err == sql.ErrNoRows {
+		err = NotFoundError("playlist")
+	}
+
+	return
+}
+
+// playlistEditableBy reports whether the user can edit the playlist.
+// Playlists of a channel belong to the owner of the channel.
+func (app *App) playlistEditableBy(p *Playlist, userID string) (bool, error) {
+	if userID == "" {
+		return false, nil
+	}
+
+	if p.ChannelID == nil {
+		return p.OwnerID == userID, nil
+	}
+
+	ownerID, err := app.SelectChannelOwnerID(*p.ChannelID)
+	if err != nil {
+		return false, err
+	}
+
+	return ownerID == userID, nil
+}
+
+func (app *App) checkPlaylistAuth(playlistID string, userID string) (*Playlist, error) {
+	p, err := app.SelectPlaylist(playlistID)
+	if err != nil {
+		return nil, err
+	}
+
+	if editable, err := app.playlistEditableBy(p, userID); err != nil {
+		return nil, err
+	} else if !editable {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "you don't have permission on this playlist")
+	}
+
+	return p, nil
+}
+
+func validatePlaylistVisibility(v *Visibility) error {
+	if v != nil && *v == VisibilityScheduled {
+		return echo.NewHTTPError(http.StatusBadRequest, "field 'visibility' should be 'PUBLIC', 'UNLISTED' or 'PRIVATE'")
+	}
+
+	return nil
+}
+
+// selectPlaylistItems returns the items after position which the user can
+// watch. The editor of the playlist sees every item.
+func (app *App) selectPlaylistItems(playlistID string, after int, limit int,
+	userID string, editor bool) ([]PlaylistItem, error) {
+	items := []PlaylistItem{}
+
+	var err error
+	if editor {
+		query := "SELECT * FROM playlist_items WHERE `playlist_id`=? AND `position` > ? ORDER BY `position` LIMIT ?"
+		err = app.db.Unsafe().Select(&items, query, playlistID, after, limit)
+	} else {
+		query := "SELECT i.* FROM playlist_items i JOIN videos v ON v.`id`=i.`video_id` " +
+			"JOIN channels c ON c.`id`=v.`channel_id` " +
+			"WHERE i.`playlist_id`=? AND i.`position` > ? AND " + videoAccessCondition + " " +
+			"ORDER BY i.`position` LIMIT ?"
+		err = app.db.Unsafe().Select(&items, query, playlistID, after, userID, limit)
+	}
+
+	if err != nil || len(items) == 0 {
+		return items, err
+	}
+
+	videoIDs := make([]string, len(items))
+	for i := range items {
+		videoIDs[i] = items[i].VideoID
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM videos WHERE `id` IN (?)", videoIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	videos := []Video{}
+	if err = app.db.Unsafe().Select(&videos, query, args...); err != nil {
+		return nil, err
+	}
+
+	if err = app.fillVideos(videos); err != nil {
+		return nil, err
+	}
+
+	byID := map[string]*Video{}
+	for i := range videos {
+		byID[videos[i].ID] = &videos[i]
+	}
+
+	for i := range items {
+		items[i].Video = byID[items[i].VideoID]
+	}
+
+	return items, nil
+}
+
+func (app *App) GetPlaylist(c echo.Context) error {
+	response := struct {
+		*Playlist
+		Pagination *string        `json:"pagination"`
+		Items      []PlaylistItem `json:"items"`
+	}{}
+
+	var err error
+	if response.Playlist, err = app.SelectPlaylist(c.Param("id")); err != nil {
+		return err
+	}
+
+	userID := GetUserID(c)
+	editor, err := app.playlistEditableBy(response.Playlist, userID)
+	if err != nil {
+		return err
+	}
+
+	if response.Visibility == VisibilityPrivate && !editor {
+		return NotFoundError("playlist")
+	}
+
+	after := -1
+	if q := c.QueryParam("pagination"); q != "" {
+		if after, err = strconv.Atoi(q); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid pagination token")
+		}
+	}
+
+	limit := 50
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	if response.Items, err = app.selectPlaylistItems(response.ID, after, limit+1, userID, editor); err != nil {
+		return err
+	}
+
+	if len(response.Items) > limit {
+		next := strconv.Itoa(response.Items[limit-1].Position)
+		response.Pagination = &next
+		response.Items = response.Items[:limit]
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (app *App) selectPlaylists(c echo.Context, condition string, args ...interface{}) error {
+	response := struct {
+		Pagination *string    `json:"pagination"`
+		Data       []Playlist `json:"data"`
+	}{Data: []Playlist{}}
+
+	pageToken := c.QueryParam("pagination")
+	limit := 20
+
+	var err error
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	if pageToken == "" {
+		query := "SELECT * FROM playlists WHERE " + condition + " ORDER BY `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&response.Data, query, append(args, limit+1)...)
+	} else {
+		query := "SELECT * FROM playlists WHERE " + condition + " AND `id` < ? ORDER BY `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&response.Data, query, append(args, pageToken, limit+1)...)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(response.Data) > limit {
+		response.Pagination = &response.Data[limit-1].ID
+		response.Data = response.Data[:limit]
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (app *App) GetChannelPlaylists(c echo.Context) error {
+	channelID := c.Param("id")
+	ownerID, err := app.SelectChannelOwnerID(channelID)
+	if err != nil {
+		return err
+	}
+
+	if userID := GetUserID(c); userID != "" && userID == ownerID {
+		return app.selectPlaylists(c, "`channel_id`=?", channelID)
+	}
+
+	return app.selectPlaylists(c, "`channel_id`=? AND `visibility`='PUBLIC'", channelID)
+}
+
+func (app *App) GetMyPlaylists(c echo.Context) error {
+	return app.selectPlaylists(c, "`owner_id`=? AND `channel_id` IS NULL", GetUserID(c))
+}
+
+func (app *App) PostPlaylist(c echo.Context) error {
+	body := struct {
+		ChannelID   *string    `json:"channel_id"`
+		Title       string     `json:"title" validate:"required,max=150"`
+		Description string     `json:"description" validate:"max=5000"`
+		Visibility  Visibility `json:"visibility"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	if err := validatePlaylistVisibility(&body.Visibility); err != nil {
+		return err
+	}
+
+	userID := GetUserID(c)
+	if body.ChannelID != nil {
+		if err := app.CheckChannelAuth(*body.ChannelID, userID); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	id := ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy)
+
+	query := "INSERT INTO playlists (`id`, `owner_id`, `channel_id`, `title`, `description`, `visibility`, " +
+		"`created_at`, `updated_at`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := app.db.Exec(query, id.String(), userID, body.ChannelID, body.Title, body.Description, body.Visibility, now, now)
+	if err != nil {
+		return err
+	}
+
+	p, err := app.SelectPlaylist(id.String())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, p)
+}
+
+func (app *App) PutPlaylist(c echo.Context) error {
+	body := struct {
+		Title       *string     `json:"title" validate:"omitempty,min=1,max=150"`
+		Description *string     `json:"description" validate:"omitempty,max=5000"`
+		Visibility  *Visibility `json:"visibility"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	if err := validatePlaylistVisibility(body.Visibility); err != nil {
+		return err
+	}
+
+	playlistID := c.Param("id")
+	p, err := app.checkPlaylistAuth(playlistID, GetUserID(c))
+	if err != nil {
+		return err
+	}
+
+	if body.Title != nil {
+		p.Title = *body.Title
+	}
+
+	if body.Description != nil {
+		p.Description = *body.Description
+	}
+
+	if body.Visibility != nil {
+		p.Visibility = *body.Visibility
+	}
+
+	query := "UPDATE playlists SET `title`=?, `description`=?, `visibility`=?, `updated_at`=CURRENT_TIMESTAMP() " +
+		"WHERE `id`=?"
+	if _, err = app.db.Exec(query, p.Title, p.Description, p.Visibility, playlistID); err != nil {
+		return err
+	}
+
+	if p, err = app.SelectPlaylist(playlistID); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, p)
+}
+
+func (app *App) DeletePlaylist(c echo.Context) error {
+	playlistID := c.Param("id")
+	if _, err := app.checkPlaylistAuth(playlistID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	if _, err := app.db.Exec("DELETE FROM playlists WHERE `id`=?", playlistID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// lockPlaylist locks the playlist for changing the positions of its items
+// and returns the number of the items.
+func lockPlaylist(tx *sqlx.Tx, playlistID string) (int, error) {
+	var count int
+	err := tx.Get(&count, "SELECT `item_count` FROM playlists WHERE `id`=? FOR UPDATE", playlistID)
+	if err == sql.ErrNoRows {
+		return 0, NotFoundError("playlist")
+	}
+
+	return count, err
+}
+
+func clampPosition(position *int, max int) int {
+	if position == nil || *position > max {
+		return max
+	}
+
+	if *position < 0 {
+		return 0
+	}
+
+	return *position
+}
+
+func (app *App) PostPlaylistItem(c echo.Context) error {
+	body := struct {
+		VideoID  string `json:"video_id" validate:"required"`
+		Position *int   `json:"position"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	userID := GetUserID(c)
+	playlistID := c.Param("id")
+	if _, err := app.checkPlaylistAuth(playlistID, userID); err != nil {
+		return err
+	}
+
+	var exist bool
+	query := "SELECT 1 FROM videos v JOIN channels c ON c.`id`=v.`channel_id` WHERE v.`id`=? AND " + videoAccessCondition
+	if err := app.db.Get(&exist, query, body.VideoID, userID); err == sql.ErrNoRows {
+		return NotFoundError("video")
+	} else if err != nil {
+		return err
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	count, err := lockPlaylist(tx, playlistID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if count >= maxPlaylistItems {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusConflict, "a playlist can't have more than 5000 videos")
+	}
+
+	query = "SELECT 1 FROM playlist_items WHERE `playlist_id`=? AND `video_id`=?"
+	if err = tx.Get(&exist, query, playlistID, body.VideoID); err == nil {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusConflict, "the video is already in the playlist")
+	} else if err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+
+	position := clampPosition(body.Position, count)
+	query = "UPDATE playlist_items SET `position`=`position`+1 WHERE `playlist_id`=? AND `position` >= ?"
+	if _, err = tx.Exec(query, playlistID, position); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	now := time.Now()
+	id := ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy)
+
+	query = "INSERT INTO playlist_items (`id`, `playlist_id`, `video_id`, `position`, `added_at`) VALUES (?, ?, ?, ?, ?)"
+	if _, err = tx.Exec(query, id.String(), playlistID, body.VideoID, position, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query = "UPDATE playlists SET `item_count`=`item_count`+1, `updated_at`=? WHERE `id`=?"
+	if _, err = tx.Exec(query, now, playlistID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	item := PlaylistItem{}
+	if err = app.db.Unsafe().Get(&item, "SELECT * FROM playlist_items WHERE `id`=?", id.String()); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, item)
+}
+
+// PutPlaylistItem moves the item to the position shifting the items between.
+func (app *App) PutPlaylistItem(c echo.Context) error {
+	body := struct {
+		Position *int `json:"position" validate:"required"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	playlistID := c.Param("id")
+	itemID := c.Param("item_id")
+	if _, err := app.checkPlaylistAuth(playlistID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	count, err := lockPlaylist(tx, playlistID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	item := PlaylistItem{}
+	query := "SELECT * FROM playlist_items WHERE `id`=? AND `playlist_id`=?"
+	if err = tx.Unsafe().Get(&item, query, itemID, playlistID); err != nil {
+		tx.Rollback()
+
+		if err == sql.ErrNoRows {
+			return NotFoundError("playlist item")
+		}
+		return err
+	}
+
+	position := clampPosition(body.Position, count-1)
+	if position < item.Position {
+		query = "UPDATE playlist_items SET `position`=`position`+1 " +
+			"WHERE `playlist_id`=? AND `position` >= ? AND `position` < ?"
+		_, err = tx.Exec(query, playlistID, position, item.Position)
+	} else if position > item.Position {
+		query = "UPDATE playlist_items SET `position`=`position`-1 " +
+			"WHERE `playlist_id`=? AND `position` > ? AND `position` <= ?"
+		_, err = tx.Exec(query, playlistID, item.Position, position)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE playlist_items SET `position`=? WHERE `id`=?", position, itemID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query = "UPDATE playlists SET `updated_at`=CURRENT_TIMESTAMP() WHERE `id`=?"
+	if _, err = tx.Exec(query, playlistID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	item.Position = position
+	return c.JSON(http.StatusOK, item)
+}
+
+// removePlaylistItem removes the item and closes the gap of positions. The
+// playlist has to be locked by the transaction.
+func removePlaylistItem(tx *sqlx.Tx, playlistID string, itemID string) error {
+	var position int
+	query := "SELECT `position` FROM playlist_items WHERE `id`=? AND `playlist_id`=?"
+	if err := tx.Get(&position, query, itemID, playlistID); err == sql.ErrNoRows {
+		return NotFoundError("playlist item")
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM playlist_items WHERE `id`=?", itemID); err != nil {
+		return err
+	}
+
+	query = "UPDATE playlist_items SET `position`=`position`-1 WHERE `playlist_id`=? AND `position` > ?"
+	if _, err := tx.Exec(query, playlistID, position); err != nil {
+		return err
+	}
+
+	query = "UPDATE playlists SET `item_count`=`item_count`-1, `updated_at`=CURRENT_TIMESTAMP() WHERE `id`=?"
+	_, err := tx.Exec(query, playlistID)
+	return err
+}
+
+func (app *App) DeletePlaylistItem(c echo.Context) error {
+	playlistID := c.Param("id")
+	if _, err := app.checkPlaylistAuth(playlistID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if _, err = lockPlaylist(tx, playlistID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = removePlaylistItem(tx, playlistID, c.Param("item_id")); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// removeVideoFromPlaylists removes every playlist item of the video.
+func removeVideoFromPlaylists(tx *sqlx.Tx, videoID string) error {
+	var items []struct {
+		ID         string `db:"id"`
+		PlaylistID string `db:"playlist_id"`
+	}
+	query := "SELECT `id`, `playlist_id` FROM playlist_items WHERE `video_id`=?"
+	if err := tx.Select(&items, query, videoID); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if _, err := lockPlaylist(tx, item.PlaylistID); err != nil {
+			return err
+		}
+
+		if err := removePlaylistItem(tx, item.PlaylistID, item.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
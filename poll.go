@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type PollOption struct {
+	ID       int    `json:"id" db:"id"`
+	PostID   string `json:"-" db:"post_id"`
+	Position int    `json:"-" db:"position"`
+	Text     string `json:"text" db:"text"`
+	Votes    uint64 `json:"votes" db:"votes"`
+}
+
+type Poll struct {
+	PostID     string       `json:"-" db:"post_id"`
+	ClosesAt   *time.Time   `json:"closes_at" db:"closes_at"`
+	TotalVotes uint64       `json:"total_votes" db:"total_votes"`
+	Options    []PollOption `json:"options" db:"-"`
+}
+
+func (p *Poll) Closed() bool {
+	return p.ClosesAt != nil && !p.ClosesAt.After(time.Now())
+}
+
+type PollInfo struct {
+	*Poll
+	Closed bool `json:"closed"`
+	MyVote *int `json:"my_vote"`
+}
+
+// SelectPolls returns polls of the posts keyed by the post ID.
+func (app *App) SelectPolls(postIDs []string) (map[string]*Poll, error) {
+	polls := map[string]*Poll{}
+	if len(postIDs) == 0 {
+		return polls, nil
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM polls WHERE `post_id` IN (?)", postIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []Poll{}
+	if err = app.db.Unsafe().Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	for i := range rows {
+		rows[i].Options = []PollOption{}
+		polls[rows[i].PostID] = &rows[i]
+	}
+
+	query, args, err = sqlx.In("SELECT * FROM poll_options WHERE `post_id` IN (?) ORDER BY `position`", postIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []PollOption{}
+	if err = app.db.Unsafe().Select(&options, query, args...); err != nil {
+		return nil, err
+	}
+
+	for _, o := range options {
+		if poll, ok := polls[o.PostID]; ok {
+			poll.Options = append(poll.Options, o)
+		}
+	}
+
+	return polls, nil
+}
+
+// insertPoll inserts the poll of a post and its options.
+func insertPoll(tx *sqlx.Tx, postID string, options []string, closesAt *time.Time) error {
+	query := "INSERT INTO polls (`post_id`, `closes_at`) VALUES (?, ?)"
+	if _, err := tx.Exec(query, postID, closesAt); err != nil {
+		return err
+	}
+
+	for i, text := range options {
+		query = "INSERT INTO poll_options (`post_id`, `position`, `text`) VALUES (?, ?, ?)"
+		if _, err := tx.Exec(query, postID, i, text); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (app *App) selectPollInfo(postID string, userID string) (*PollInfo, error) {
+	polls, err := app.SelectPolls([]string{postID})
+	if err != nil {
+		return nil, err
+	}
+
+	poll, ok := polls[postID]
+	if !ok {
+		return nil, NotFoundError("poll")
+	}
+
+	info := &PollInfo{Poll: poll, Closed: poll.Closed()}
+	if userID != "" {
+		query := "SELECT `option_id` FROM poll_votes WHERE `post_id`=? AND `user_id`=?"
+		if err = app.db.Get(&info.MyVote, query, postID, userID); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+func (app *App) GetPoll(c echo.Context) error {
+	postID := c.Param("id")
+	if _, err := app.SelectPost(postID); err != nil {
+		return err
+	}
+
+	info, err := app.selectPollInfo(postID, GetUserID(c))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, info)
+}
+
+// lockPoll locks the poll of an active post for updating its vote counters.
+func lockPoll(tx *sqlx.Tx, postID string) (*Poll, error) {
+	poll := &Poll{}
+	query := "SELECT l.* FROM polls l JOIN posts p ON l.`post_id`=p.`id` " +
+		"WHERE l.`post_id`=? AND p.`deactivated_at` IS NULL FOR UPDATE"
+	if err := tx.Unsafe().Get(poll, query, postID); err == sql.ErrNoRows {
+		return nil, NotFoundError("poll")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if poll.Closed() {
+		return nil, echo.NewHTTPError(http.StatusConflict, "the poll is closed")
+	}
+
+	return poll, nil
+}
+
+// removePollVote cancels the vote of the user and returns whether it existed.
+func removePollVote(tx *sqlx.Tx, postID string, userID string) (bool, error) {
+	var optionID int
+	query := "SELECT `option_id` FROM poll_votes WHERE `post_id`=? AND `user_id`=? FOR UPDATE"
+	if err := tx.Get(&optionID, query, postID, userID); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM poll_votes WHERE `post_id`=? AND `user_id`=?", postID, userID); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec("UPDATE poll_options SET `votes`=`votes`-1 WHERE `id`=?", optionID); err != nil {
+		return false, err
+	}
+
+	_, err := tx.Exec("UPDATE polls SET `total_votes`=`total_votes`-1 WHERE `post_id`=?", postID)
+	return true, err
+}
+
+func (app *App) PutPollVote(c echo.Context) error {
+	body := struct {
+		OptionID *int `json:"option_id" validate:"required"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	postID := c.Param("id")
+	userID := GetUserID(c)
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if _, err = lockPoll(tx, postID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var exist bool
+	query := "SELECT 1 FROM poll_options WHERE `id`=? AND `post_id`=?"
+	if err = tx.Get(&exist, query, *body.OptionID, postID); err != nil {
+		tx.Rollback()
+
+		if err == sql.ErrNoRows {
+			return NotFoundError("poll option")
+		}
+		return err
+	}
+
+	if _, err = removePollVote(tx, postID, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query = "INSERT INTO poll_votes (`post_id`, `user_id`, `option_id`, `voted_at`) VALUES (?, ?, ?, ?)"
+	if _, err = tx.Exec(query, postID, userID, *body.OptionID, time.Now()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE poll_options SET `votes`=`votes`+1 WHERE `id`=?", *body.OptionID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.Exec("UPDATE polls SET `total_votes`=`total_votes`+1 WHERE `post_id`=?", postID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return app.respondPollVote(c, postID, userID)
+}
+
+func (app *App) DeletePollVote(c echo.Context) error {
+	postID := c.Param("id")
+	userID := GetUserID(c)
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if _, err = lockPoll(tx, postID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = removePollVote(tx, postID, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return app.respondPollVote(c, postID, userID)
+}
+
+// respondPollVote publishes the current results of the poll to the live
+// result room and responds them with the vote of the user.
+func (app *App) respondPollVote(c echo.Context, postID string, userID string) error {
+	info, err := app.selectPollInfo(postID, userID)
+	if err != nil {
+		return err
+	}
+
+	if app.ws != nil {
+		app.ws.Publish(pollRoom(postID), "results", info.Poll)
+	}
+
+	return c.JSON(http.StatusOK, info)
+}
+
+type PollOptionBreakdown struct {
+	ID             int    `json:"id" db:"id"`
+	Text           string `json:"text" db:"text"`
+	Votes          uint64 `json:"votes" db:"votes"`
+	Subscribers    uint64 `json:"subscribers" db:"subscribers"`
+	NonSubscribers uint64 `json:"non_subscribers" db:"non_subscribers"`
+}
+
+// GetPollResults shows the channel owner how subscribers and the others
+// voted for each option.
+func (app *App) GetPollResults(c echo.Context) error {
+	postID := c.Param("id")
+	if err := app.checkPostAuth(postID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	polls, err := app.SelectPolls([]string{postID})
+	if err != nil {
+		return err
+	}
+
+	poll, ok := polls[postID]
+	if !ok {
+		return NotFoundError("poll")
+	}
+
+	response := struct {
+		ClosesAt   *time.Time            `json:"closes_at"`
+		Closed     bool                  `json:"closed"`
+		TotalVotes uint64                `json:"total_votes"`
+		Options    []PollOptionBreakdown `json:"options"`
+	}{poll.ClosesAt, poll.Closed(), poll.TotalVotes, []PollOptionBreakdown{}}
+
+	query := `SELECT o.id, o.text, o.votes, COUNT(s.user_id) subscribers, COUNT(v.user_id)-COUNT(s.user_id) non_subscribers
+		FROM poll_options o
+		JOIN posts p ON p.id=o.post_id
+		LEFT JOIN poll_votes v ON v.option_id=o.id
+		LEFT JOIN subscriptions s ON s.channel_id=p.channel_id AND s.user_id=v.user_id
+		WHERE o.post_id=? GROUP BY o.id ORDER BY o.position`
+	if err = app.db.Select(&response.Options, query, postID); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func pollRoom(postID string) string {
+	return fmt.Sprintf("post/%s/poll", postID)
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+type PostType int
+
+const (
+	PostText PostType = iota
+	PostImage
+	PostPoll
+)
+
+func (t PostType) String() string {
+	switch t {
+	case PostText:
+		return "TEXT"
+	case PostImage:
+		return "IMAGE"
+	case PostPoll:
+		return "POLL"
+	}
+
+	return ""
+}
+
+func parsePostType(s string) (PostType, error) {
+	switch strings.ToUpper(s) {
+	case "TEXT":
+		return PostText, nil
+	case "IMAGE":
+		return PostImage, nil
+	case "POLL":
+		return PostPoll, nil
+	}
+
+	return 0, errors.New("invalid value for PostType")
+}
+
+func (t PostType) Value() (driver.Value, error) {
+	return t.String(), nil
+}
+
+func (t *PostType) Scan(src interface{}) (err error) {
+	switch src.(type) {
+	case string:
+		*t, err = parsePostType(src.(string))
+	case []byte:
+		*t, err = parsePostType(string(src.([]byte)))
+	default:
+		err = errors.New("invalid type for PostType")
+	}
+	return
+}
+
+func (t PostType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *PostType) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	*t, err = parsePostType(s)
+	return err
+}
+
+type Post struct {
+	ID            string            `json:"id" db:"id"`
+	ChannelID     string            `json:"channel_id" db:"channel_id"`
+	Type          PostType          `json:"type" db:"type"`
+	Content       string            `json:"content" db:"content"`
+	Image         *string           `json:"image" db:"image"`
+	ImageURLs     map[string]string `json:"image_urls" db:"-"`
+	Poll          *Poll             `json:"poll,omitempty" db:"-"`
+	PostedAt      time.Time         `json:"posted_at" db:"posted_at"`
+	UpdatedAt     time.Time         `json:"updated_at" db:"updated_at"`
+	DeactivatedAt *time.Time        `json:"deactivated_at" db:"deactivated_at"`
+}
+
+func (app *App) SelectPost(id string) (p *Post, err error) {
+	p = &Post{}
+	err = app.db.Unsafe().Get(p, "SELECT * FROM posts WHERE `id`=? AND `deactivated_at` IS NULL", id)
+	if err == sql.ErrNoRows {
+		err = NotFoundError("post")
+	} else if err == nil {
+		posts := []Post{*p}
+		err = app.fillPosts(posts)
+		*p = posts[0]
+	}
+
+	return
+}
+
+// fillPosts sets the fields of posts which are not stored in the posts table.
+func (app *App) fillPosts(posts []Post) error {
+	pollIDs := []string{}
+	for i := range posts {
+		posts[i].ImageURLs = app.imageURLs(posts[i].Image, app.Config.PostImage)
+		if posts[i].Type == PostPoll {
+			pollIDs = append(pollIDs, posts[i].ID)
+		}
+	}
+
+	polls, err := app.SelectPolls(pollIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range posts {
+		posts[i].Poll = polls[posts[i].ID]
+	}
+
+	return nil
+}
+
+func (app *App) GetPost(c echo.Context) error {
+	post, err := app.SelectPost(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, post)
+}
+
+func (app *App) GetChannelPosts(c echo.Context) error {
+	response := struct {
+		Pagination *string `json:"pagination"`
+		Data       []Post  `json:"data"`
+	}{Data: []Post{}}
+
+	channelID := c.Param("id")
+
+	pageToken := c.QueryParam("pagination")
+	limit := 20
+
+	var err error
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	if pageToken == "" {
+		query := "SELECT * FROM posts WHERE `channel_id`=? AND `deactivated_at` IS NULL ORDER BY `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&response.Data, query, channelID, limit+1)
+	} else {
+		query := "SELECT * FROM posts WHERE `channel_id`=? AND `id` < ? AND `deactivated_at` IS NULL " +
+			"ORDER BY `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&response.Data, query, channelID, pageToken, limit+1)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(response.Data) > limit {
+		response.Pagination = &response.Data[limit-1].ID
+		response.Data = response.Data[:limit]
+	}
+
+	if err = app.fillPosts(response.Data); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (app *App) PostChannelPost(c echo.Context) error {
+	body := struct {
+		Content string `json:"content" form:"content" validate:"required,max=5000"`
+		Poll    *struct {
+			Options  []string   `json:"options" validate:"min=2,max=5,dive,required,max=65"`
+			ClosesAt *time.Time `json:"closes_at"`
+		} `json:"poll"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	if body.Poll != nil && body.Poll.ClosesAt != nil && !body.Poll.ClosesAt.After(time.Now()) {
+		return echo.NewHTTPError(http.StatusBadRequest, "field 'closes_at' has to be in the future")
+	}
+
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	id := ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy)
+	postType := PostText
+
+	if body.Poll != nil {
+		postType = PostPoll
+	}
+
+	var image *string
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		if header, err := c.FormFile("file"); err == nil {
+			if postType == PostPoll {
+				return echo.NewHTTPError(http.StatusBadRequest, "a poll post can't have an image")
+			}
+
+			img, err := decodeImageFile(header, app.imageLimits(0, 0))
+			if err != nil {
+				return err
+			}
+
+			fileName := "p" + id.String()
+			if err = app.storeImageVariants(img, app.Config.PostImage, centerCrop, fileName); err != nil {
+				return err
+			}
+
+			image = &fileName
+			postType = PostImage
+		} else if err != http.ErrMissingFile {
+			return err
+		}
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO posts (`id`, `channel_id`, `type`, `content`, `image`, `posted_at`, `updated_at`) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?)"
+	if _, err = tx.Exec(query, id.String(), channelID, postType, body.Content, image, now, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if body.Poll != nil {
+		if err = insertPoll(tx, id.String(), body.Poll.Options, body.Poll.ClosesAt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	post, err := app.SelectPost(id.String())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, post)
+}
+
+// checkPostAuth checks whether the user owns the channel of the post.
+func (app *App) checkPostAuth(postID string, userID string) error {
+	var owner string
+	query := "SELECT c.`owner` FROM posts p JOIN channels c ON p.`channel_id`=c.`id` " +
+		"WHERE p.`id`=? AND p.`deactivated_at` IS NULL"
+	if err := app.db.Get(&owner, query, postID); err == sql.ErrNoRows {
+		return NotFoundError("post")
+	} else if err != nil {
+		return err
+	}
+
+	if owner != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "you don't have permission on this post")
+	}
+
+	return nil
+}
+
+func (app *App) PutPost(c echo.Context) error {
+	body := struct {
+		Content string `json:"content" validate:"required,max=5000"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	postID := c.Param("id")
+	if err := app.checkPostAuth(postID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	query := "UPDATE posts SET `content`=?, `updated_at`=CURRENT_TIMESTAMP() WHERE `id`=?"
+	if _, err := app.db.Exec(query, body.Content, postID); err != nil {
+		return err
+	}
+
+	post, err := app.SelectPost(postID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, post)
+}
+
+func (app *App) DeletePost(c echo.Context) error {
+	postID := c.Param("id")
+	if err := app.checkPostAuth(postID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	query := "UPDATE posts SET `deactivated_at`=CURRENT_TIMESTAMP() WHERE `id`=?"
+	if _, err := app.db.Exec(query, postID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (app *App) GetPostComments(c echo.Context) error {
+	response := struct {
+		Pagination *string   `json:"pagination"`
+		Data       []Comment `json:"data"`
+	}{Data: []Comment{}}
+
+	postID := c.Param("id")
+
+	pageToken := c.QueryParam("pagination")
+	limit := 20
+
+	var err error
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	if _, err = app.SelectPost(postID); err != nil {
+		return err
+	}
+
+	if pageToken == "" {
+		query := "SELECT * FROM comments WHERE `post_id`=? ORDER BY `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&response.Data, query, postID, limit+1)
+	} else {
+		query := "SELECT * FROM comments WHERE `post_id`=? AND `id` < ? ORDER BY `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&response.Data, query, postID, pageToken, limit+1)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(response.Data) == limit+1 {
+		response.Pagination = &response.Data[limit-1].ID
+		response.Data = response.Data[:limit]
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+type FeedItem struct {
+	Type  string `json:"type"`
+	Video *Video `json:"video,omitempty"`
+	Post  *Post  `json:"post,omitempty"`
+
+	at time.Time
+	id string
+}
+
+// GetFeed lists the videos and the posts of the subscribed channels from the
+// newest. Both are ordered by the time they are posted and their ULIDs, and
+// the ID of the last item is the pagination token.
+func (app *App) GetFeed(c echo.Context) error {
+	response := struct {
+		Pagination *string    `json:"pagination"`
+		Data       []FeedItem `json:"data"`
+	}{Data: []FeedItem{}}
+
+	userID := GetUserID(c)
+	pageToken := c.QueryParam("pagination")
+	limit := 20
+
+	var err error
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	// The token may be the ID of either a video or a post.
+	cursor := time.Now()
+	if pageToken != "" {
+		query := "SELECT " + postedOrder("v") + " FROM videos v WHERE v.`id`=? " +
+			"UNION ALL SELECT `posted_at` FROM posts WHERE `id`=? LIMIT 1"
+		if err = app.db.Get(&cursor, query, pageToken, pageToken); err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid pagination token")
+		} else if err != nil {
+			return err
+		}
+	}
+
+	videos := []Video{}
+	query := `SELECT v.* FROM videos v JOIN subscriptions s ON v.channel_id=s.channel_id
+		WHERE s.user_id=? AND (?='' OR (` + postedOrder("v") + `, v.id) < (?, ?))
+		AND v.status='ACTIVE' AND v.visibility='PUBLIC'
+		ORDER BY ` + postedOrder("v") + ` DESC, v.id DESC LIMIT ?`
+	err = app.db.Unsafe().Select(&videos, query, userID, pageToken, cursor, pageToken, limit+1)
+	if err != nil {
+		return err
+	}
+
+	posts := []Post{}
+	query = `SELECT p.* FROM posts p JOIN subscriptions s ON p.channel_id=s.channel_id
+		WHERE s.user_id=? AND (?='' OR (p.posted_at, p.id) < (?, ?)) AND p.deactivated_at IS NULL
+		ORDER BY p.posted_at DESC, p.id DESC LIMIT ?`
+	err = app.db.Unsafe().Select(&posts, query, userID, pageToken, cursor, pageToken, limit+1)
+	if err != nil {
+		return err
+	}
+
+	if err = app.fillVideos(videos); err != nil {
+		return err
+	}
+
+	if err = app.fillPosts(posts); err != nil {
+		return err
+	}
+
+	items := make([]FeedItem, 0, len(videos)+len(posts))
+	for i := range videos {
+		// Videos which are not posted yet are sorted by the time they are uploaded.
+		at := ulid.Time(ulid.MustParse(videos[i].ID).Time())
+		if videos[i].PostedAt != nil {
+			at = *videos[i].PostedAt
+		}
+
+		items = append(items, FeedItem{Type: "video", Video: &videos[i], at: at, id: videos[i].ID})
+	}
+
+	for i := range posts {
+		items = append(items, FeedItem{Type: "post", Post: &posts[i], at: posts[i].PostedAt, id: posts[i].ID})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].at.Equal(items[j].at) {
+			return items[i].at.After(items[j].at)
+		}
+
+		return items[i].id > items[j].id
+	})
+
+	if len(items) > limit {
+		response.Pagination = &items[limit-1].id
+		items = items[:limit]
+	}
+
+	response.Data = items
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// RunScheduler runs the periodic jobs until the process exits.
+func (app *App) RunScheduler() {
+	ticker := time.NewTicker(time.Duration(app.Config.SchedulerInterval) * time.Second)
+	defer ticker.Stop()
+
+	jobs := []func() error{
+		app.publishScheduledVideos,
+		app.purgeDeletedVideos,
+		app.flushViews,
+		app.flushPlayback,
+		app.flushProgress,
+		app.expireEncodingJobs,
+	}
+
+	for range ticker.C {
+		for _, job := range jobs {
+			if err := job(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// flushBuffers writes the counts buffered in memory into the database. It is
+// called on shutdown so that they are not lost until the next interval.
+func (app *App) flushBuffers() {
+	for _, job := range []func() error{app.flushViews, app.flushPlayback, app.flushProgress} {
+		if err := job(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+type SectionType int
+
+const (
+	SectionFeaturedVideo SectionType = iota
+	SectionPopular
+	SectionLatest
+	SectionPlaylist
+)
+
+func (t SectionType) String() string {
+	switch t {
+	case SectionFeaturedVideo:
+		return "FEATURED_VIDEO"
+	case SectionPopular:
+		return "POPULAR"
+	case SectionLatest:
+		return "LATEST"
+	case SectionPlaylist:
+		return "PLAYLIST"
+	}
+
+	return ""
+}
+
+func parseSectionType(s string) (SectionType, error) {
+	switch strings.ToUpper(s) {
+	case "FEATURED_VIDEO":
+		return SectionFeaturedVideo, nil
+	case "POPULAR":
+		return SectionPopular, nil
+	case "LATEST":
+		return SectionLatest, nil
+	case "PLAYLIST":
+		return SectionPlaylist, nil
+	}
+
+	return 0, errors.New("invalid value for SectionType")
+}
+
+func (t SectionType) Value() (driver.Value, error) {
+	return t.String(), nil
+}
+
+func (t *SectionType) Scan(src interface{}) (err error) {
+	switch src.(type) {
+	case string:
+		*t, err = parseSectionType(src.(string))
+	case []byte:
+		*t, err = parseSectionType(string(src.([]byte)))
+	default:
+		err = errors.New("invalid type for SectionType")
+	}
+	return
+}
+
+func (t SectionType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *SectionType) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	*t, err = parseSectionType(s)
+	return err
+}
+
+// sectionVideoLimit is the number of videos rendered in a list section.
+const sectionVideoLimit = 12
+
+type ChannelSection struct {
+	ID         string      `json:"id" db:"id"`
+	ChannelID  string      `json:"channel_id" db:"channel_id"`
+	Position   int         `json:"position" db:"position"`
+	Type       SectionType `json:"type" db:"type"`
+	Title      *string     `json:"title" db:"title"`
+	VideoID    *string     `json:"video_id" db:"video_id"`
+	PlaylistID *string     `json:"playlist_id" db:"playlist_id"`
+}
+
+func (app *App) SelectChannelSections(channelID string) ([]ChannelSection, error) {
+	sections := []ChannelSection{}
+	query := "SELECT * FROM channel_sections WHERE `channel_id`=? ORDER BY `position`"
+	err := app.db.Unsafe().Select(&sections, query, channelID)
+	return sections, err
+}
+
+func (app *App) GetChannelSections(c echo.Context) error {
+	sections, err := app.SelectChannelSections(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"data": sections})
+}
+
+func (app *App) PutChannelSections(c echo.Context) error {
+	body := struct {
+		Sections []struct {
+			Type       *SectionType `json:"type" validate:"required"`
+			Title      *string      `json:"title" validate:"omitempty,max=100"`
+			VideoID    *string      `json:"video_id"`
+			PlaylistID *string      `json:"playlist_id"`
+		} `json:"sections" validate:"max=10,dive"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM channel_sections WHERE `channel_id`=?", channelID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for i, section := range body.Sections {
+		if *section.Type == SectionFeaturedVideo {
+			if section.VideoID == nil {
+				tx.Rollback()
+				return echo.NewHTTPError(http.StatusBadRequest, "field 'video_id' is missing")
+			}
+
+			var exist bool
+			query := "SELECT 1 FROM videos " +
+				"WHERE `id`=? AND `channel_id`=? AND `status`='ACTIVE' AND `visibility`='PUBLIC'"
+			if err = tx.Get(&exist, query, *section.VideoID, channelID); err != nil {
+				tx.Rollback()
+
+				if err == sql.ErrNoRows {
+					return NotFoundError("video")
+				}
+				return err
+			}
+		} else {
+			section.VideoID = nil
+		}
+
+		if *section.Type == SectionPlaylist {
+			if section.PlaylistID == nil {
+				tx.Rollback()
+				return echo.NewHTTPError(http.StatusBadRequest, "field 'playlist_id' is missing")
+			}
+
+			var exist bool
+			query := "SELECT 1 FROM playlists WHERE `id`=? AND `channel_id`=? AND `visibility`='PUBLIC'"
+			if err = tx.Get(&exist, query, *section.PlaylistID, channelID); err != nil {
+				tx.Rollback()
+
+				if err == sql.ErrNoRows {
+					return NotFoundError("playlist")
+				}
+				return err
+			}
+		} else {
+			section.PlaylistID = nil
+		}
+
+		now := time.Now()
+		id := ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy)
+
+		query := "INSERT INTO channel_sections (`id`, `channel_id`, `position`, `type`, `title`, `video_id`, " +
+			"`playlist_id`) VALUES (?, ?, ?, ?, ?, ?, ?)"
+		_, err = tx.Exec(query, id.String(), channelID, i, *section.Type, section.Title, section.VideoID, section.PlaylistID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	sections, err := app.SelectChannelSections(channelID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"data": sections})
+}
+
+type RenderedSection struct {
+	ChannelSection
+	Videos []Video `json:"videos"`
+}
+
+func (app *App) renderSection(section *ChannelSection) (*RenderedSection, error) {
+	rendered := &RenderedSection{ChannelSection: *section, Videos: []Video{}}
+
+	var err error
+	switch section.Type {
+	case SectionFeaturedVideo:
+		query := "SELECT * FROM videos WHERE `id`=? AND `status`='ACTIVE' AND `visibility`='PUBLIC'"
+		err = app.db.Unsafe().Select(&rendered.Videos, query, section.VideoID)
+	case SectionPopular:
+		query := "SELECT * FROM videos WHERE `channel_id`=? AND `status`='ACTIVE' AND `visibility`='PUBLIC' " +
+			"ORDER BY `likes` DESC, `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&rendered.Videos, query, section.ChannelID, sectionVideoLimit)
+	case SectionLatest:
+		query := "SELECT * FROM videos v WHERE v.`channel_id`=? AND v.`status`='ACTIVE' AND v.`visibility`='PUBLIC' " +
+			"ORDER BY " + postedOrder("v") + " DESC, v.`id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&rendered.Videos, query, section.ChannelID, sectionVideoLimit)
+	case SectionPlaylist:
+		query := "SELECT v.* FROM playlist_items i JOIN videos v ON v.`id`=i.`video_id` " +
+			"JOIN playlists p ON p.`id`=i.`playlist_id` AND p.`visibility`='PUBLIC' " +
+			"WHERE i.`playlist_id`=? AND v.`status`='ACTIVE' AND v.`visibility`='PUBLIC' " +
+			"ORDER BY i.`position` LIMIT ?"
+		err = app.db.Unsafe().Select(&rendered.Videos, query, section.PlaylistID, sectionVideoLimit)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = app.fillVideos(rendered.Videos); err != nil {
+		return nil, err
+	}
+
+	return rendered, nil
+}
+
+func (app *App) GetChannelHome(c echo.Context) error {
+	response := struct {
+		Channel  *Channel          `json:"channel"`
+		Sections []RenderedSection `json:"sections"`
+	}{Sections: []RenderedSection{}}
+
+	var err error
+	if response.Channel, err = app.SelectChannel(c.Param("id")); err != nil {
+		return err
+	}
+
+	sections, err := app.SelectChannelSections(response.Channel.ID)
+	if err != nil {
+		return err
+	}
+
+	// Channels which have never arranged their home show the latest uploads.
+	if len(sections) == 0 {
+		sections = []ChannelSection{{ChannelID: response.Channel.ID, Type: SectionLatest}}
+	}
+
+	for i := range sections {
+		rendered, err := app.renderSection(&sections[i])
+		if err != nil {
+			return err
+		}
+
+		if len(rendered.Videos) > 0 {
+			response.Sections = append(response.Sections, *rendered)
+		}
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
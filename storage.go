@@ -14,8 +14,14 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
+// errNoRemoveCommand is returned by custom storages which can not remove
+// files without a remove command.
+var errNoRemoveCommand = errors.New("remove_command is not configured for the storage")
+
 type storage interface {
 	storeFile(src string, dst string) error
+	// removeFiles removes every stored file under the directory dir.
+	removeFiles(dir string) error
 }
 
 type storageConfig struct {
@@ -23,6 +29,8 @@ type storageConfig struct {
 	AWSEndpoint string   `json:"aws_endpoint,omitempty"`
 	Bucket      string   `json:"bucket,omitempty"`
 	Command     []string `json:"command,omitempty"`
+	RemoveCmd   []string `json:"remove_command,omitempty"`
+	URL         string   `json:"url,omitempty"`
 }
 
 func createStorage(cfg *storageConfig) (storage, error) {
@@ -49,22 +57,36 @@ func createStorage(cfg *storageConfig) (storage, error) {
 			bucket: cfg.Bucket,
 		}, nil
 	} else if strings.EqualFold(cfg.Type, "custom") {
-		return customStorage(cfg.Command), nil
+		return &customStorage{cfg.Command, cfg.RemoveCmd}, nil
 	}
 
 	return nil, errors.New("Invalid storage type")
 }
 
-type customStorage []string
+type customStorage struct {
+	command       []string
+	removeCommand []string
+}
 
-func (s customStorage) storeFile(src string, dst string) error {
-	replacer := strings.NewReplacer("${src}", src, "${dst}", dst)
-	args := make([]string, len(s)-1)
+func runCommand(command []string, replacer *strings.Replacer) error {
+	args := make([]string, len(command)-1)
 	for i := range args {
-		args[i] = replacer.Replace(s[i+1])
+		args[i] = replacer.Replace(command[i+1])
 	}
 
-	return exec.Command(s[0], args...).Run()
+	return exec.Command(command[0], args...).Run()
+}
+
+func (s *customStorage) storeFile(src string, dst string) error {
+	return runCommand(s.command, strings.NewReplacer("${src}", src, "${dst}", dst))
+}
+
+func (s *customStorage) removeFiles(dir string) error {
+	if len(s.removeCommand) == 0 {
+		return errNoRemoveCommand
+	}
+
+	return runCommand(s.removeCommand, strings.NewReplacer("${dst}", dir))
 }
 
 type s3Storage struct {
@@ -108,3 +130,37 @@ func (s *s3Storage) storeFile(src string, dst string) error {
 		return err
 	}
 }
+
+func (s *s3Storage) removeFiles(dir string) error {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return err
+		}
+
+		if len(page.Contents) == 0 {
+			continue
+		}
+
+		objects := make([]types.ObjectIdentifier, len(page.Contents))
+		for i, o := range page.Contents {
+			objects[i] = types.ObjectIdentifier{Key: o.Key}
+		}
+
+		_, err = s.client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: true},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
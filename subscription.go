@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+type opml struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    struct {
+		Title       string `xml:"title"`
+		DateCreated string `xml:"dateCreated"`
+	} `xml:"head"`
+	Body struct {
+		Outlines []opmlOutline `xml:"outline"`
+	} `xml:"body"`
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Title    string        `xml:"title,attr,omitempty"`
+	Type     string        `xml:"type,attr,omitempty"`
+	XMLURL   string        `xml:"xmlUrl,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+func (o *opmlOutline) feedURLs() []string {
+	urls := []string{}
+	if o.XMLURL != "" {
+		urls = append(urls, o.XMLURL)
+	}
+
+	for i := range o.Outlines {
+		urls = append(urls, o.Outlines[i].feedURLs()...)
+	}
+
+	return urls
+}
+
+type SubscriptionExport struct {
+	ChannelID    string            `json:"channel_id" db:"channel_id"`
+	Handle       *string           `json:"handle" db:"handle"`
+	Name         string            `json:"name" db:"name"`
+	FeedURL      string            `json:"feed_url" db:"-"`
+	Notification NotificationLevel `json:"notification" db:"notification"`
+	SubscribedAt time.Time         `json:"subscribed_at" db:"subscribed_at"`
+}
+
+func (app *App) GetSubscriptionExport(c echo.Context) error {
+	subscriptions := []SubscriptionExport{}
+	query := `SELECT s.channel_id, c.handle, c.name, s.notification, s.subscribed_at
+		FROM subscriptions s JOIN channels c ON c.id=s.channel_id
+		WHERE s.user_id=? ORDER BY s.subscribed_at`
+	if err := app.db.Select(&subscriptions, query, GetUserID(c)); err != nil {
+		return err
+	}
+
+	for i := range subscriptions {
+		subscriptions[i].FeedURL = app.channelFeedURL(subscriptions[i].ChannelID)
+	}
+
+	switch c.QueryParam("format") {
+	case "", "json":
+		return c.JSON(http.StatusOK, echo.Map{"data": subscriptions})
+	case "opml":
+		doc := opml{Version: "1.1"}
+		doc.Head.Title = "MyStream Subscriptions"
+		doc.Head.DateCreated = time.Now().Format(time.RFC1123Z)
+
+		root := opmlOutline{Text: doc.Head.Title, Title: doc.Head.Title}
+		for _, s := range subscriptions {
+			root.Outlines = append(root.Outlines, opmlOutline{
+				Text:   s.Name,
+				Title:  s.Name,
+				Type:   "rss",
+				XMLURL: s.FeedURL,
+			})
+		}
+		doc.Body.Outlines = []opmlOutline{root}
+
+		c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="subscriptions.opml"`)
+		return c.XML(http.StatusOK, doc)
+	}
+
+	return echo.NewHTTPError(http.StatusBadRequest, "value of 'format' has to be 'json' or 'opml'")
+}
+
+var feedURLPattern = regexp.MustCompile(`/channels/([0-9A-HJKMNP-TV-Z]{26})/rss$`)
+var channelIDPattern = regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`)
+
+// resolveChannels finds the IDs of channels referred by entries. Each entry
+// can be a channel ID, a handle with or without '@' or a channel feed URL.
+// It returns a map from entry to channel ID, which lacks unresolved entries.
+func (app *App) resolveChannels(entries []string) (map[string]string, error) {
+	resolved := map[string]string{}
+	ids := map[string][]string{}
+	handles := map[string][]string{}
+
+	for _, entry := range entries {
+		ref := strings.TrimSpace(entry)
+		if m := feedURLPattern.FindStringSubmatch(ref); m != nil {
+			ids[m[1]] = append(ids[m[1]], entry)
+		} else if channelIDPattern.MatchString(strings.ToUpper(ref)) {
+			ids[strings.ToUpper(ref)] = append(ids[strings.ToUpper(ref)], entry)
+		} else if h := strings.ToLower(strings.TrimPrefix(ref, "@")); h != "" {
+			handles[h] = append(handles[h], entry)
+		}
+	}
+
+	if len(ids) > 0 {
+		keys := make([]string, 0, len(ids))
+		for id := range ids {
+			keys = append(keys, id)
+		}
+
+		query, args, err := sqlx.In("SELECT `id` FROM channels WHERE `id` IN (?)", keys)
+		if err != nil {
+			return nil, err
+		}
+
+		var found []string
+		if err = app.db.Select(&found, query, args...); err != nil {
+			return nil, err
+		}
+
+		for _, id := range found {
+			for _, entry := range ids[id] {
+				resolved[entry] = id
+			}
+		}
+	}
+
+	if len(handles) > 0 {
+		keys := make([]string, 0, len(handles))
+		for h := range handles {
+			keys = append(keys, h)
+		}
+
+		query, args, err := sqlx.In("SELECT `handle`, `id`, 1 `current` FROM channels WHERE `handle` IN (?) "+
+			"UNION ALL SELECT `handle`, `channel_id`, 0 FROM channel_handles WHERE `handle` IN (?) AND `released_at` > ? "+
+			"ORDER BY `current` DESC", keys, keys, app.handleGraceStart())
+		if err != nil {
+			return nil, err
+		}
+
+		var found []struct {
+			Handle  string `db:"handle"`
+			ID      string `db:"id"`
+			Current bool   `db:"current"`
+		}
+		if err = app.db.Select(&found, query, args...); err != nil {
+			return nil, err
+		}
+
+		for _, f := range found {
+			for _, entry := range handles[strings.ToLower(f.Handle)] {
+				if _, ok := resolved[entry]; !ok {
+					resolved[entry] = f.ID
+				}
+			}
+		}
+	}
+
+	return resolved, nil
+}
+
+func (app *App) PostSubscriptionImport(c echo.Context) error {
+	body := struct {
+		Channels     []string           `json:"channels" validate:"max=1000"`
+		Notification *NotificationLevel `json:"notification"`
+	}{}
+
+	if ct := c.Request().Header.Get(echo.HeaderContentType); strings.Contains(ct, "xml") || strings.Contains(ct, "opml") {
+		var doc opml
+		if err := xml.NewDecoder(c.Request().Body).Decode(&doc); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid OPML document")
+		}
+
+		for i := range doc.Body.Outlines {
+			body.Channels = append(body.Channels, doc.Body.Outlines[i].feedURLs()...)
+		}
+	} else if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	level := NotificationAll
+	if body.Notification != nil {
+		level = *body.Notification
+	}
+
+	response := struct {
+		Subscribed        []string `json:"subscribed"`
+		AlreadySubscribed []string `json:"already_subscribed"`
+		Unresolved        []string `json:"unresolved"`
+	}{[]string{}, []string{}, []string{}}
+
+	resolved, err := app.resolveChannels(body.Channels)
+	if err != nil {
+		return err
+	}
+
+	channelIDs := []string{}
+	seen := map[string]bool{}
+	for _, entry := range body.Channels {
+		if id, ok := resolved[entry]; !ok {
+			response.Unresolved = append(response.Unresolved, entry)
+		} else if !seen[id] {
+			seen[id] = true
+			channelIDs = append(channelIDs, id)
+		}
+	}
+
+	if len(channelIDs) == 0 {
+		return c.JSON(http.StatusOK, response)
+	}
+
+	userID := GetUserID(c)
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	query, args, err := sqlx.In("SELECT `channel_id` FROM subscriptions "+
+		"WHERE `user_id`=? AND `channel_id` IN (?) FOR UPDATE", userID, channelIDs)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var existing []string
+	if err = tx.Select(&existing, query, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	subscribed := map[string]bool{}
+	for _, id := range existing {
+		subscribed[id] = true
+	}
+
+	now := time.Now()
+	for _, id := range channelIDs {
+		if subscribed[id] {
+			response.AlreadySubscribed = append(response.AlreadySubscribed, id)
+			continue
+		}
+
+		if err = insertSubscription(tx, userID, id, level, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		response.Subscribed = append(response.Subscribed, id)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
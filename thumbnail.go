@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/disintegration/imaging"
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+)
+
+const maxThumbnailCandidates = 5
+
+// legacyThumbnail is the name of the single JPEG thumbnail which videos had
+// before thumbnails were stored in variants. It is still stored in the first
+// size for clients which build its URL.
+const legacyThumbnail = "thumbnail.jpg"
+
+const legacyBackfillBatch = 100
+
+var storageClient = &http.Client{Timeout: 10 * time.Second}
+
+func isLegacyThumbnail(key string) bool {
+	return strings.HasSuffix(key, "/"+legacyThumbnail)
+}
+
+// formatExtension returns the file extension of an image format.
+func formatExtension(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+
+	return format
+}
+
+// storeThumbnail stores every variant of thumbnails in every format into
+// the video storage under the directory named key. JPEG is encoded by the
+// server and the other formats by the commands of image_encoders from PNG.
+func (app *App) storeThumbnail(img image.Image, hint cropHint, key string) error {
+	dir, err := ioutil.TempDir("", "thumbnail")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, o := range app.Config.Thumbnails {
+		resized := o.render(img, hint)
+
+		for _, format := range app.Config.ThumbnailFormats {
+			path := fmt.Sprintf("%s/%s.%s", dir, o.Name(), formatExtension(format))
+			if format == "jpeg" {
+				if err = imaging.Save(resized, path, imaging.JPEGQuality(o.Quality)); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			src := fmt.Sprintf("%s/%s.%s.png", dir, o.Name(), format)
+			if err = imaging.Save(resized, src); err != nil {
+				return err
+			}
+
+			err = runCommand(app.Config.ImageEncoders[format],
+				strings.NewReplacer("${src}", src, "${dst}", path, "${quality}", strconv.Itoa(o.Quality)))
+			os.Remove(src)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return app.videoStorage.storeFile(dir, key)
+}
+
+// storeLegacyThumbnail stores the thumbnail in the first size as JPEG into
+// the path of the legacy thumbnail of the video.
+func (app *App) storeLegacyThumbnail(img image.Image, hint cropHint, videoID string) error {
+	o := app.Config.Thumbnails[0]
+
+	temp, err := ioutil.TempFile("", "thumbnail")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if err = imaging.Encode(temp, o.render(img, hint), imaging.JPEG, imaging.JPEGQuality(o.Quality)); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err = temp.Close(); err != nil {
+		return err
+	}
+
+	return app.videoStorage.storeFile(temp.Name(), videoID+"/"+legacyThumbnail)
+}
+
+// fetchThumbnail downloads the thumbnail stored under the key in the first
+// size, since storages can not copy files.
+func (app *App) fetchThumbnail(key string) (image.Image, error) {
+	urls := app.thumbnailURLs(&key)
+	format := app.Config.ThumbnailFormats[0]
+	if _, ok := urls["jpeg"]; ok {
+		format = "jpeg"
+	}
+
+	resp, err := storageClient.Get(urls[format][app.Config.Thumbnails[0].Name()])
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch the thumbnail: %s", resp.Status)
+	}
+
+	return decodeImage(resp.Body, app.imageLimits(0, 0))
+}
+
+// thumbnailURLs returns the URLs of thumbnails by format and size. A legacy
+// thumbnail is returned as JPEG for every size.
+func (app *App) thumbnailURLs(key *string) map[string]map[string]string {
+	if key == nil {
+		return nil
+	}
+
+	if isLegacyThumbnail(*key) {
+		urls := make(map[string]string, len(app.Config.Thumbnails))
+		for _, o := range app.Config.Thumbnails {
+			urls[o.Name()] = storageURL(&app.Config.Storages.Video, *key)
+		}
+
+		return map[string]map[string]string{"jpeg": urls}
+	}
+
+	urls := make(map[string]map[string]string, len(app.Config.ThumbnailFormats))
+	for _, format := range app.Config.ThumbnailFormats {
+		urls[format] = make(map[string]string, len(app.Config.Thumbnails))
+		for _, o := range app.Config.Thumbnails {
+			path := *key + "/" + o.Name() + "." + formatExtension(format)
+			urls[format][o.Name()] = storageURL(&app.Config.Storages.Video, path)
+		}
+	}
+
+	return urls
+}
+
+// setThumbnail changes the thumbnail of the video and removes the previous
+// one unless it is still a candidate. Legacy thumbnails are kept until the
+// video is purged.
+func (app *App) setThumbnail(videoID string, key string, ph placeholder) error {
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var prev *string
+	if err = tx.Get(&prev, "SELECT `thumbnail` FROM videos WHERE `id`=? FOR UPDATE", videoID); err == sql.ErrNoRows {
+		tx.Rollback()
+		return NotFoundError("video")
+	} else if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	query := "UPDATE videos SET `thumbnail`=?, `thumbnail_blurhash`=?, `thumbnail_color`=? WHERE `id`=?"
+	if _, err = tx.Exec(query, key, ph.blurhash, ph.color, videoID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	candidate := false
+	if prev != nil {
+		query := "SELECT EXISTS (SELECT 1 FROM thumbnail_candidates WHERE `video_id`=? AND `key`=?)"
+		if err = tx.Get(&candidate, query, videoID, *prev); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if prev != nil && *prev != key && !candidate && !isLegacyThumbnail(*prev) {
+		app.videoStorage.removeFiles(*prev)
+	}
+
+	return nil
+}
+
+// PutThumbnail sets the thumbnail of a video from an uploaded image file, or
+// from a candidate frame with a JSON body of {"candidate": position}. It
+// responds with the URLs and the placeholder of the new thumbnail.
+func (app *App) PutThumbnail(c echo.Context) error {
+	videoID := c.Param("id")
+	if err := app.checkVideoOwner(videoID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	var key string
+	var ph placeholder
+	var legacy image.Image
+	legacyHint := centerCrop
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		body := struct {
+			Candidate *int `json:"candidate" validate:"required"`
+		}{}
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		if err := c.Validate(body); err != nil {
+			return err
+		}
+
+		query := "SELECT `key`, `blurhash`, `color` FROM thumbnail_candidates WHERE `video_id`=? AND `position`=?"
+		err := app.db.QueryRow(query, videoID, *body.Candidate).Scan(&key, &ph.blurhash, &ph.color)
+		if err == sql.ErrNoRows {
+			return NotFoundError("candidate")
+		} else if err != nil {
+			return err
+		}
+	} else {
+		hint, err := parseCropHint(c)
+		if err != nil {
+			return err
+		}
+
+		header, err := c.FormFile("file")
+		if err != nil {
+			return err
+		}
+
+		img, err := decodeImageFile(header, app.imageLimits(minThumbnailWidth, minThumbnailHeight))
+		if err != nil {
+			return err
+		}
+
+		key = videoID + "/thumbnails/" + ulid.MustNew(ulid.Timestamp(time.Now()), app.ulidEntropy).String()
+		if err = app.storeThumbnail(img, hint, key); err != nil {
+			return err
+		}
+
+		ph = computePlaceholder(img)
+		legacy, legacyHint = img, hint
+	}
+
+	if err := app.setThumbnail(videoID, key, ph); err != nil {
+		return err
+	}
+
+	// Frames of candidates are fetched back from the storage, which can be
+	// done only if it is served by URL.
+	if legacy == nil && app.Config.Storages.Video.URL != "" {
+		var err error
+		if legacy, err = app.fetchThumbnail(key); err != nil {
+			return err
+		}
+	}
+
+	if legacy != nil {
+		if err := app.storeLegacyThumbnail(legacy, legacyHint, videoID); err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"thumbnail_urls":     app.thumbnailURLs(&key),
+		"thumbnail_blurhash": ph.blurhash,
+		"thumbnail_color":    ph.color,
+	})
+}
+
+type ThumbnailCandidate struct {
+	Position int                          `json:"position" db:"position"`
+	Key      string                       `json:"-" db:"key"`
+	URLs     map[string]map[string]string `json:"urls" db:"-"`
+	Selected bool                         `json:"selected" db:"selected"`
+}
+
+func (app *App) GetThumbnailCandidates(c echo.Context) error {
+	videoID := c.Param("id")
+	if err := app.checkVideoOwner(videoID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	candidates := []ThumbnailCandidate{}
+	query := "SELECT t.`position`, t.`key`, t.`key` <=> v.`thumbnail` selected FROM thumbnail_candidates t " +
+		"JOIN videos v ON v.`id`=t.`video_id` WHERE t.`video_id`=? ORDER BY t.`position`"
+	if err := app.db.Select(&candidates, query, videoID); err != nil {
+		return err
+	}
+
+	for i := range candidates {
+		candidates[i].URLs = app.thumbnailURLs(&candidates[i].Key)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"data": candidates})
+}
+
+// PostThumbnailCandidates replaces candidate frames of a video with the ones
+// supplied by the encoder. The first candidate becomes the thumbnail if the
+// video does not have one yet.
+func (app *App) PostThumbnailCandidates(c echo.Context) error {
+	videoID := c.Param("id")
+
+	token, ok := c.Get("uploadToken").(*jwtgo.Token)
+	if !ok {
+		return echo.ErrUnauthorized
+	}
+
+	claims := token.Claims.(jwtgo.MapClaims)
+	if id, ok := claims["video_id"].(string); !ok || id != videoID || claims["iss"] != "encoder" {
+		return echo.ErrUnauthorized
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return err
+	}
+
+	files := form.File["files"]
+	if len(files) == 0 || len(files) > maxThumbnailCandidates {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("number of 'files' has to be 1~%d", maxThumbnailCandidates))
+	}
+
+	var prev []string
+	if err = app.db.Select(&prev, "SELECT `key` FROM thumbnail_candidates WHERE `video_id`=?", videoID); err != nil {
+		return err
+	}
+
+	keys := make([]string, len(files))
+	placeholders := make([]placeholder, len(files))
+	var first image.Image
+	for i, header := range files {
+		// Frames of the encoder are as small as the video.
+		img, err := decodeImageFile(header, app.imageLimits(0, 0))
+		if err != nil {
+			return err
+		}
+
+		keys[i] = videoID + "/candidates/" + ulid.MustNew(ulid.Timestamp(time.Now()), app.ulidEntropy).String()
+		if err = app.storeThumbnail(img, centerCrop, keys[i]); err != nil {
+			return err
+		}
+
+		placeholders[i] = computePlaceholder(img)
+		if i == 0 {
+			first = img
+		}
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var current *string
+	if err = tx.Get(&current, "SELECT `thumbnail` FROM videos WHERE `id`=? FOR UPDATE", videoID); err == sql.ErrNoRows {
+		tx.Rollback()
+		return NotFoundError("video")
+	} else if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM thumbnail_candidates WHERE `video_id`=?", videoID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for i, key := range keys {
+		query := "INSERT INTO thumbnail_candidates (`video_id`, `position`, `key`, `blurhash`, `color`) VALUES (?, ?, ?, ?, ?)"
+		if _, err = tx.Exec(query, videoID, i, key, placeholders[i].blurhash, placeholders[i].color); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if current == nil {
+		query := "UPDATE videos SET `thumbnail`=?, `thumbnail_blurhash`=?, `thumbnail_color`=? WHERE `id`=?"
+		if _, err = tx.Exec(query, keys[0], placeholders[0].blurhash, placeholders[0].color, videoID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if current == nil {
+		if err = app.storeLegacyThumbnail(first, centerCrop, videoID); err != nil {
+			return err
+		}
+	}
+
+	// Previous candidates are removed unless one of them is the thumbnail.
+	for _, key := range prev {
+		if current == nil || key != *current {
+			app.videoStorage.removeFiles(key)
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// PostLegacyThumbnails sets the legacy thumbnails of videos uploaded before
+// thumbnails were stored in variants, only if the files exist in the video
+// storage. It checks a batch of videos at once, so admins call it again with
+// the pagination token until it is null.
+func (app *App) PostLegacyThumbnails(c echo.Context) error {
+	if err := app.CheckAdmin(GetUserID(c)); err != nil {
+		return err
+	}
+
+	if app.Config.Storages.Video.URL == "" {
+		return echo.NewHTTPError(http.StatusConflict, "url of the video storage is not configured")
+	}
+
+	response := struct {
+		Pagination *string `json:"pagination"`
+		Updated    int     `json:"updated"`
+	}{}
+
+	var ids []string
+	query := "SELECT `id` FROM videos WHERE `thumbnail` IS NULL AND `id` > ? ORDER BY `id` LIMIT ?"
+	if err := app.db.Select(&ids, query, c.QueryParam("pagination"), legacyBackfillBatch); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		key := id + "/" + legacyThumbnail
+		resp, err := storageClient.Head(storageURL(&app.Config.Storages.Video, key))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		query := "UPDATE videos SET `thumbnail`=? WHERE `id`=? AND `thumbnail` IS NULL"
+		if _, err = app.db.Exec(query, key, id); err != nil {
+			return err
+		}
+		response.Updated++
+	}
+
+	if len(ids) == legacyBackfillBatch {
+		response.Pagination = &ids[len(ids)-1]
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
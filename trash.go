@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// purgeBatchSize is the maximum number of videos purged in a scheduler run.
+const purgeBatchSize = 100
+
+// retentionStart returns the time before which deleted videos are purged.
+func (app *App) retentionStart() time.Time {
+	return time.Now().Add(-time.Duration(app.Config.VideoRetention) * time.Second)
+}
+
+type DeletedVideo struct {
+	Video
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+func (app *App) GetChannelTrash(c echo.Context) error {
+	response := struct {
+		Pagination *string        `json:"pagination"`
+		Data       []DeletedVideo `json:"data"`
+	}{Data: []DeletedVideo{}}
+
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	pageToken := c.QueryParam("pagination")
+	limit := 20
+
+	var err error
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	videos := []Video{}
+	if pageToken == "" {
+		query := "SELECT * FROM videos WHERE `channel_id`=? AND `status`='INACTIVE' AND `deactivated_at` > ? " +
+			"ORDER BY `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&videos, query, channelID, app.retentionStart(), limit+1)
+	} else {
+		query := "SELECT * FROM videos WHERE `channel_id`=? AND `id` < ? " +
+			"AND `status`='INACTIVE' AND `deactivated_at` > ? ORDER BY `id` DESC LIMIT ?"
+		err = app.db.Unsafe().Select(&videos, query, channelID, pageToken, app.retentionStart(), limit+1)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(videos) > limit {
+		response.Pagination = &videos[limit-1].ID
+		videos = videos[:limit]
+	}
+
+	if err = app.fillVideos(videos); err != nil {
+		return err
+	}
+
+	retention := time.Duration(app.Config.VideoRetention) * time.Second
+	for _, v := range videos {
+		response.Data = append(response.Data, DeletedVideo{v, v.DeactivatedAt.Add(retention)})
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (app *App) PostVideoRestore(c echo.Context) error {
+	videoID := c.Param("id")
+
+	var ownerID string
+	query := `SELECT c.owner FROM videos v JOIN channels c ON v.channel_id=c.id
+			  WHERE v.id=? AND v.status='INACTIVE' AND v.deactivated_at > ?`
+	if err := app.db.Get(&ownerID, query, videoID, app.retentionStart()); err == sql.ErrNoRows {
+		return NotFoundError("video")
+	} else if err != nil {
+		return err
+	}
+
+	if ownerID != GetUserID(c) {
+		return echo.NewHTTPError(http.StatusForbidden, "you don't have permission on this video")
+	}
+
+	query = "UPDATE videos SET `status`='ACTIVE', `deactivated_at`=NULL, `updated_at`=CURRENT_TIMESTAMP() " +
+		"WHERE `id`=? AND `status`='INACTIVE'"
+	if _, err := app.db.Exec(query, videoID); err != nil {
+		return err
+	}
+
+	video, err := app.SelectVideo(videoID)
+	if err != nil {
+		return err
+	}
+
+	if err = app.indexVideo(video); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, video)
+}
+
+// purgeDeletedVideos permanently removes the data of videos deleted before
+// the retention period. Videos whose files fail to be removed are skipped
+// until the next run, and nothing is purged if the storage can not remove
+// files at all.
+func (app *App) purgeDeletedVideos() error {
+	var ids []string
+	query := "SELECT `id` FROM videos WHERE `status`='INACTIVE' AND `deactivated_at` <= ? " +
+		"ORDER BY `deactivated_at`, `id` LIMIT ?"
+	if err := app.db.Select(&ids, query, app.retentionStart(), purgeBatchSize); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := app.videoStorage.removeFiles(id); err == errNoRemoveCommand {
+			return err
+		} else if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		tx, err := app.db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		if err = removeVideoFromPlaylists(tx, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		for _, query := range []string{
+			"DELETE FROM comments WHERE `video_id`=?",
+			"DELETE FROM expressions WHERE `video_id`=?",
+			"DELETE FROM videos WHERE `id`=? AND `status`='INACTIVE'",
+		} {
+			if _, err = tx.Exec(query, id); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+
+		app.unindexVideo(id)
+	}
+
+	return nil
+}
@@ -3,16 +3,12 @@ package main
 import (
 	"bytes"
 	"database/sql"
-	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/go-sql-driver/mysql"
 	"github.com/labstack/echo/v4"
 	"github.com/lestrrat-go/jwx/jwa"
@@ -22,12 +18,14 @@ import (
 )
 
 type User struct {
-	ID            string     `json:"id" db:"id"`
-	Email         string     `json:"email" db:"email"`
-	Name          string     `json:"name" db:"name"`
-	Picture       *string    `json:"picture" db:"picture"`
-	RegisterdAt   time.Time  `json:"registered_at" db:"registered_at"`
-	DeactivatedAt *time.Time `json:"deactivated_at" db:"deactivated_at"`
+	ID              string     `json:"id" db:"id"`
+	Email           string     `json:"email" db:"email"`
+	Name            string     `json:"name" db:"name"`
+	Picture         *string    `json:"picture" db:"picture"`
+	PictureBlurhash *string    `json:"picture_blurhash" db:"picture_blurhash"`
+	PictureColor    *string    `json:"picture_color" db:"picture_color"`
+	RegisterdAt     time.Time  `json:"registered_at" db:"registered_at"`
+	DeactivatedAt   *time.Time `json:"deactivated_at" db:"deactivated_at"`
 }
 
 func (app *App) SelectUser(id string) (u *User, err error) {
@@ -177,6 +175,7 @@ func (app *App) GetMyChannels(c echo.Context) error {
 		response.Data = response.Data[:limit]
 	}
 
+	app.setChannelURLs(response.Data)
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -237,50 +236,21 @@ func (app *App) PutUserPicture(c echo.Context) error {
 		return err
 	}
 
-	file, err := header.Open()
+	img, err := decodeImageFile(header, app.imageLimits(minPictureSide, minPictureSide))
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	img, err := imaging.Decode(file)
-	if err != nil {
-		return err
-	}
-
-	dir, err := ioutil.TempDir("", "picture")
-	if err != nil {
-		return err
-	}
-	defer os.RemoveAll(dir)
-
-	for _, o := range app.Config.UserPicture {
-		output, err := os.Create(fmt.Sprintf("%s/%dx%d.jpg", dir, o.Width, o.Height))
-		if err != nil {
-			return err
-		}
-
-		resized := imaging.Fill(img, o.Width, o.Height, imaging.Center, imaging.Lanczos)
-		err = imaging.Encode(output, resized, imaging.JPEG, imaging.JPEGQuality(app.Config.Thumbnail.Quality))
-		if err != nil {
-			output.Close()
-			return err
-		}
-
-		if err = output.Close(); err != nil {
-			return err
-		}
-	}
 
 	now := time.Now()
 	fileName := "u" + userID + ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy).String()
 
-	if err = app.imageStorage.storeFile(dir, fileName); err != nil {
+	if err = app.storeImageVariants(img, app.Config.UserPicture, centerCrop, fileName); err != nil {
 		return err
 	}
 
-	_, err = app.db.Exec("UPDATE users SET `picture`=? WHERE `id`=?", fileName, userID)
-	if err != nil {
+	ph := computePlaceholder(img)
+	query := "UPDATE users SET `picture`=?, `picture_blurhash`=?, `picture_color`=? WHERE `id`=?"
+	if _, err = app.db.Exec(query, fileName, ph.blurhash, ph.color, userID); err != nil {
 		return err
 	}
 
@@ -356,6 +326,20 @@ func (app *App) AuthUserMiddleware(allowUnauth bool) echo.MiddlewareFunc {
 	}
 }
 
+func (app *App) CheckAdmin(userID string) error {
+	var isAdmin bool
+	err := app.db.Get(&isAdmin, "SELECT `is_admin` FROM users WHERE `id`=?", userID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if !isAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "you don't have permission to do this")
+	}
+
+	return nil
+}
+
 func hashPassword(password string) []byte {
 	salt := make([]byte, 16)
 	rand.New(rand.NewSource(time.Now().UnixNano())).Read(salt)
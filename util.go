@@ -3,10 +3,42 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"net/http"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
 )
 
+const dateLayout = "2006-01-02"
+
+// parseDateRange reads the 'from' and 'to' query parameters in YYYY-MM-DD.
+// Dates are in UTC like the times stored in the database. The range defaults
+// to the last 28 days and can not exceed 366 days.
+func parseDateRange(c echo.Context) (from time.Time, to time.Time, err error) {
+	to = time.Now().UTC().Truncate(24 * time.Hour)
+	from = to.AddDate(0, 0, -27)
+
+	if q := c.QueryParam("from"); q != "" {
+		if from, err = time.Parse(dateLayout, q); err != nil {
+			return from, to, echo.NewHTTPError(http.StatusBadRequest, "value of 'from' has to be YYYY-MM-DD")
+		}
+	}
+
+	if q := c.QueryParam("to"); q != "" {
+		if to, err = time.Parse(dateLayout, q); err != nil {
+			return from, to, echo.NewHTTPError(http.StatusBadRequest, "value of 'to' has to be YYYY-MM-DD")
+		}
+	}
+
+	if to.Before(from) || to.Sub(from) > 366*24*time.Hour {
+		return from, to, echo.NewHTTPError(http.StatusBadRequest, "date range has to be 1~366 days")
+	}
+
+	return from, to, nil
+}
+
 func RowToJSON(rows *sqlx.Rows) ([]byte, error) {
 	cols, err := rows.Columns()
 	if err != nil {
@@ -65,3 +97,19 @@ func RowsToJSON(rows *sqlx.Rows) ([]byte, error) {
 	buffer.WriteByte(']')
 	return buffer.Bytes(), nil
 }
+
+// nullIfEmpty returns nil for an empty string so that it is stored as NULL.
+func nullIfEmpty(s *string) *string {
+	if s == nil || *s == "" {
+		return nil
+	}
+
+	return s
+}
+
+// isForeignKeyError reports whether err is caused by a missing parent row,
+// such as a video deleted before its buffered statistics are flushed.
+func isForeignKeyError(err error) bool {
+	v, ok := err.(*mysql.MySQLError)
+	return ok && (v.Number == 1216 || v.Number == 1452)
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+	"github.com/olivere/elastic/v7"
+)
+
+// verifiedBoost is the score boost of verified channels and their videos in search results.
+const verifiedBoost = 2.0
+
+type VerificationStatus int
+
+const (
+	VerificationPending VerificationStatus = iota
+	VerificationApproved
+	VerificationRejected
+	VerificationRevoked
+)
+
+func (v VerificationStatus) String() string {
+	switch v {
+	case VerificationPending:
+		return "PENDING"
+	case VerificationApproved:
+		return "APPROVED"
+	case VerificationRejected:
+		return "REJECTED"
+	case VerificationRevoked:
+		return "REVOKED"
+	}
+
+	return ""
+}
+
+func parseVerificationStatus(s string) (VerificationStatus, error) {
+	switch strings.ToUpper(s) {
+	case "PENDING":
+		return VerificationPending, nil
+	case "APPROVED":
+		return VerificationApproved, nil
+	case "REJECTED":
+		return VerificationRejected, nil
+	case "REVOKED":
+		return VerificationRevoked, nil
+	}
+
+	return 0, errors.New("invalid value for VerificationStatus")
+}
+
+func (v VerificationStatus) Value() (driver.Value, error) {
+	return v.String(), nil
+}
+
+func (v *VerificationStatus) Scan(src interface{}) (err error) {
+	switch src.(type) {
+	case string:
+		*v, err = parseVerificationStatus(src.(string))
+	case []byte:
+		*v, err = parseVerificationStatus(string(src.([]byte)))
+	default:
+		err = errors.New("invalid type for VerificationStatus")
+	}
+	return
+}
+
+func (v VerificationStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func (v *VerificationStatus) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	*v, err = parseVerificationStatus(s)
+	return err
+}
+
+type VerificationRequest struct {
+	ID          string             `json:"id" db:"id"`
+	ChannelID   string             `json:"channel_id" db:"channel_id"`
+	RequesterID string             `json:"requester_id" db:"requester_id"`
+	Message     string             `json:"message" db:"message"`
+	Status      VerificationStatus `json:"status" db:"status"`
+	Note        *string            `json:"note" db:"note"`
+	ReviewerID  *string            `json:"reviewer_id" db:"reviewer_id"`
+	RequestedAt time.Time          `json:"requested_at" db:"requested_at"`
+	ReviewedAt  *time.Time         `json:"reviewed_at" db:"reviewed_at"`
+}
+
+func (app *App) SelectVerificationRequest(id string) (r *VerificationRequest, err error) {
+	r = &VerificationRequest{}
+	err = app.db.Unsafe().Get(r, "SELECT * FROM verification_requests WHERE `id`=?", id)
+	if err == sql.ErrNoRows {
+		err = NotFoundError("verification request")
+	}
+
+	return
+}
+
+func (app *App) GetChannelVerification(c echo.Context) error {
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, GetUserID(c)); err != nil {
+		return err
+	}
+
+	r := VerificationRequest{}
+	query := "SELECT * FROM verification_requests WHERE `channel_id`=? ORDER BY `id` DESC LIMIT 1"
+	if err := app.db.Unsafe().Get(&r, query, channelID); err == sql.ErrNoRows {
+		return NotFoundError("verification request")
+	} else if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, r)
+}
+
+func (app *App) PostChannelVerification(c echo.Context) error {
+	body := struct {
+		Message string `json:"message" validate:"required,max=2000"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	userID := GetUserID(c)
+	channelID := c.Param("id")
+	if err := app.CheckChannelAuth(channelID, userID); err != nil {
+		return err
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var verified bool
+	if err = tx.Get(&verified, "SELECT `verified` FROM channels WHERE `id`=? FOR UPDATE", channelID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if verified {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusConflict, "the channel is already verified")
+	}
+
+	query := "SELECT 1 FROM verification_requests WHERE `channel_id`=? AND `status`='PENDING'"
+	rows, err := tx.Query(query, channelID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	pending := rows.Next()
+	rows.Close()
+	if pending {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusConflict, "a verification request is already pending")
+	}
+
+	now := time.Now()
+	id := ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy)
+
+	query = "INSERT INTO verification_requests (`id`, `channel_id`, `requester_id`, `message`, `requested_at`) " +
+		"VALUES (?, ?, ?, ?, ?)"
+	if _, err = tx.Exec(query, id.String(), channelID, userID, body.Message, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	r, err := app.SelectVerificationRequest(id.String())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, r)
+}
+
+func (app *App) GetVerificationRequests(c echo.Context) error {
+	response := struct {
+		Pagination *string               `json:"pagination"`
+		Data       []VerificationRequest `json:"data"`
+	}{Data: []VerificationRequest{}}
+
+	if err := app.CheckAdmin(GetUserID(c)); err != nil {
+		return err
+	}
+
+	status := VerificationPending
+	if q := c.QueryParam("status"); q != "" {
+		var err error
+		if status, err = parseVerificationStatus(q); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "value of 'status' has to be 'PENDING', 'APPROVED', 'REJECTED' or 'REVOKED'")
+		}
+	}
+
+	pageToken := c.QueryParam("pagination")
+	limit := 20
+
+	var err error
+	if q := c.QueryParam("limit"); q != "" {
+		limit, err = strconv.Atoi(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limit < 1 || limit > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
+	}
+
+	// Pending requests are reviewed first in, first out.
+	if pageToken == "" {
+		query := "SELECT * FROM verification_requests WHERE `status`=? ORDER BY `id` LIMIT ?"
+		err = app.db.Unsafe().Select(&response.Data, query, status, limit+1)
+	} else {
+		query := "SELECT * FROM verification_requests WHERE `status`=? AND `id` > ? ORDER BY `id` LIMIT ?"
+		err = app.db.Unsafe().Select(&response.Data, query, status, pageToken, limit+1)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(response.Data) > limit {
+		response.Pagination = &response.Data[limit-1].ID
+		response.Data = response.Data[:limit]
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (app *App) PutVerificationRequest(c echo.Context) error {
+	body := struct {
+		Status *VerificationStatus `json:"status" validate:"required"`
+		Note   *string             `json:"note" validate:"omitempty,max=2000"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	if *body.Status != VerificationApproved && *body.Status != VerificationRejected {
+		return echo.NewHTTPError(http.StatusBadRequest, "field 'status' should be 'APPROVED' or 'REJECTED'")
+	}
+
+	userID := GetUserID(c)
+	if err := app.CheckAdmin(userID); err != nil {
+		return err
+	}
+
+	requestID := c.Param("id")
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	r := VerificationRequest{}
+	query := "SELECT * FROM verification_requests WHERE `id`=? FOR UPDATE"
+	if err = tx.Unsafe().Get(&r, query, requestID); err != nil {
+		tx.Rollback()
+
+		if err == sql.ErrNoRows {
+			return NotFoundError("verification request")
+		}
+		return err
+	}
+
+	if r.Status != VerificationPending {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusConflict, "the verification request is already reviewed")
+	}
+
+	now := time.Now()
+	query = "UPDATE verification_requests SET `status`=?, `note`=?, `reviewer_id`=?, `reviewed_at`=? WHERE `id`=?"
+	if _, err = tx.Exec(query, *body.Status, body.Note, userID, now, requestID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if *body.Status == VerificationApproved {
+		query = "UPDATE channels SET `verified`=1, `updated_at`=? WHERE `id`=?"
+		if _, err = tx.Exec(query, now, r.ChannelID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if *body.Status == VerificationApproved {
+		if err = app.indexChannelVerification(r.ChannelID); err != nil {
+			return err
+		}
+	}
+
+	updated, err := app.SelectVerificationRequest(requestID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, updated)
+}
+
+// revokeVerification removes the badge of the channel and marks its approved
+// request revoked. It reports whether the channel was verified.
+func revokeVerification(tx *sqlx.Tx, channelID string, reviewerID *string, note *string, now time.Time) (bool, error) {
+	res, err := tx.Exec("UPDATE channels SET `verified`=0, `updated_at`=? WHERE `id`=? AND `verified`=1", now, channelID)
+	if err != nil {
+		return false, err
+	}
+
+	if rows, err := res.RowsAffected(); err != nil || rows == 0 {
+		return false, err
+	}
+
+	query := "UPDATE verification_requests SET `status`='REVOKED', `note`=?, `reviewer_id`=?, `reviewed_at`=? " +
+		"WHERE `channel_id`=? AND `status`='APPROVED'"
+	if _, err = tx.Exec(query, note, reviewerID, now, channelID); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (app *App) DeleteChannelVerification(c echo.Context) error {
+	body := struct {
+		Note *string `json:"note" validate:"omitempty,max=2000"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	userID := GetUserID(c)
+	if err := app.CheckAdmin(userID); err != nil {
+		return err
+	}
+
+	channelID := c.Param("id")
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	revoked, err := revokeVerification(tx, channelID, &userID, body.Note, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if !revoked {
+		tx.Rollback()
+		return echo.NewHTTPError(http.StatusConflict, "the channel is not verified")
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if err = app.indexChannelVerification(channelID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// indexChannelVerification reindexes the channel and updates the badge of
+// its videos in the search index.
+func (app *App) indexChannelVerification(channelID string) error {
+	channel, err := app.SelectChannel(channelID)
+	if err != nil {
+		return err
+	}
+
+	if err = app.indexChannel(channel); err != nil {
+		return err
+	}
+
+	_, err = app.es.UpdateByQuery(app.Config.Elasticsearch.VideoIndex).
+		Query(elastic.NewTermQuery("channel_id", channelID)).
+		Script(elastic.NewScript("ctx._source.channel_verified = params.verified").
+			Param("verified", channel.Verified)).
+		ProceedOnVersionConflict().
+		Do(context.Background())
+
+	return err
+}
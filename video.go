@@ -7,15 +7,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	jwtgo "github.com/dgrijalva/jwt-go"
-	"github.com/disintegration/imaging"
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwt"
@@ -89,20 +87,50 @@ func (v *VideoStatus) UnmarshalJSON(data []byte) error {
 }
 
 type Video struct {
-	ID            string      `json:"id" db:"id"`
-	ChannelID     string      `json:"channel_id" db:"channel_id"`
-	Title         string      `json:"title" db:"title"`
-	Description   string      `json:"description" db:"description"`
-	Width         int         `json:"width" db:"width"`
-	Height        int         `json:"height" db:"height"`
-	FrameRate     int         `json:"frame_rate" db:"frame_rate"`
-	Duration      float32     `json:"duration" db:"duration"`
-	Status        VideoStatus `json:"status" db:"status"`
-	Likes         uint64      `json:"likes" db:"likes"`
-	Dislikes      uint64      `json:"dislikes" db:"dislikes"`
-	PostedAt      *time.Time  `json:"posted_at" db:"posted_at"`
-	UpdatedAt     time.Time   `json:"updated_at" db:"updated_at"`
-	DeactivatedAt *time.Time  `json:"deactivated_at" db:"deactivated_at"`
+	ID                string        `json:"id" db:"id"`
+	ChannelID         string        `json:"channel_id" db:"channel_id"`
+	Title             string        `json:"title" db:"title"`
+	Description       string        `json:"description" db:"description"`
+	Width             int           `json:"width" db:"width"`
+	Height            int           `json:"height" db:"height"`
+	FrameRate         int           `json:"frame_rate" db:"frame_rate"`
+	Duration          float32       `json:"duration" db:"duration"`
+	Status            VideoStatus   `json:"status" db:"status"`
+	Visibility        Visibility    `json:"visibility" db:"visibility"`
+	PublishAt         *time.Time    `json:"publish_at" db:"publish_at"`
+	CategoryID        *string       `json:"category_id" db:"category_id"`
+	Language          *string       `json:"language" db:"language"`
+	ContentRating     ContentRating `json:"content_rating" db:"content_rating"`
+	ChaptersExplicit  bool          `json:"chapters_explicit" db:"chapters_explicit"`
+	Thumbnail         *string       `json:"-" db:"thumbnail"`
+	ThumbnailBlurhash *string       `json:"thumbnail_blurhash" db:"thumbnail_blurhash"`
+	ThumbnailColor    *string       `json:"thumbnail_color" db:"thumbnail_color"`
+	Views             uint64        `json:"views" db:"views"`
+	Likes             uint64        `json:"likes" db:"likes"`
+	Dislikes          uint64        `json:"dislikes" db:"dislikes"`
+	PostedAt          *time.Time    `json:"posted_at" db:"posted_at"`
+	UpdatedAt         time.Time     `json:"updated_at" db:"updated_at"`
+	DeactivatedAt     *time.Time    `json:"deactivated_at" db:"deactivated_at"`
+
+	ChannelVerified bool                         `json:"channel_verified" db:"-"`
+	ThumbnailURLs   map[string]map[string]string `json:"thumbnail_urls" db:"-"`
+	Tags            []string                     `json:"tags" db:"-"`
+	ResumePosition  *float64                     `json:"resume_position,omitempty" db:"-"`
+	Captions        []CaptionTrack               `json:"captions,omitempty" db:"-"`
+	Chapters        []Chapter                    `json:"chapters,omitempty" db:"-"`
+}
+
+// postedOrder returns the key which lists of videos are sorted by. Videos
+// which are not posted yet are sorted by the time they are uploaded.
+func postedOrder(alias string) string {
+	return "IFNULL(" + alias + ".`posted_at`, " + alias + ".`post_started_at`)"
+}
+
+// postedBefore returns the condition of videos listed after the video whose
+// ID is the pagination token.
+func postedBefore(alias string) string {
+	return "(" + postedOrder(alias) + ", " + alias + ".`id`) < " +
+		"(SELECT " + postedOrder("t") + ", t.`id` FROM videos t WHERE t.`id`=?)"
 }
 
 func (app *App) SelectVideo(id string) (v *Video, err error) {
@@ -110,11 +138,113 @@ func (app *App) SelectVideo(id string) (v *Video, err error) {
 	err = app.db.Unsafe().Get(v, "SELECT * FROM videos WHERE `id`=?", id)
 	if err == sql.ErrNoRows {
 		err = NotFoundError("video")
+	} else if err == nil {
+		videos := []Video{*v}
+		err = app.fillVideos(videos)
+		*v = videos[0]
 	}
 
 	return
 }
 
+// fillVideos sets the fields of videos which are not stored in the videos table.
+func (app *App) fillVideos(videos []Video) error {
+	if len(videos) == 0 {
+		return nil
+	}
+
+	videoIDs := make([]string, len(videos))
+	channelIDs := []string{}
+	for i, v := range videos {
+		videoIDs[i] = v.ID
+		if v.ChannelID != "" {
+			channelIDs = append(channelIDs, v.ChannelID)
+		}
+	}
+
+	query, args, err := sqlx.In("SELECT `video_id`, `tag` FROM video_tags WHERE `video_id` IN (?) ORDER BY `position`",
+		videoIDs)
+	if err != nil {
+		return err
+	}
+
+	var tagRows []struct {
+		VideoID string `db:"video_id"`
+		Tag     string `db:"tag"`
+	}
+	if err = app.db.Select(&tagRows, query, args...); err != nil {
+		return err
+	}
+
+	tags := map[string][]string{}
+	for _, t := range tagRows {
+		tags[t.VideoID] = append(tags[t.VideoID], t.Tag)
+	}
+
+	for i := range videos {
+		videos[i].ThumbnailURLs = app.thumbnailURLs(videos[i].Thumbnail)
+		videos[i].Tags = tags[videos[i].ID]
+		if videos[i].Tags == nil {
+			videos[i].Tags = []string{}
+		}
+	}
+
+	if len(channelIDs) == 0 {
+		return nil
+	}
+
+	query, args, err = sqlx.In("SELECT `id`, `verified` FROM channels WHERE `id` IN (?)", channelIDs)
+	if err != nil {
+		return err
+	}
+
+	var rows []struct {
+		ID       string `db:"id"`
+		Verified bool   `db:"verified"`
+	}
+	if err = app.db.Select(&rows, query, args...); err != nil {
+		return err
+	}
+
+	verified := map[string]bool{}
+	for _, r := range rows {
+		verified[r.ID] = r.Verified
+	}
+
+	for i := range videos {
+		videos[i].ChannelVerified = verified[videos[i].ChannelID]
+	}
+
+	return nil
+}
+
+// indexVideo puts the video into the search index, or removes it if the
+// video is not listed.
+func (app *App) indexVideo(video *Video) error {
+	if !video.Listed() {
+		app.unindexVideo(video.ID)
+		return nil
+	}
+
+	_, err := app.es.Index().
+		Index(app.Config.Elasticsearch.VideoIndex).
+		Id(video.ID).
+		BodyJson(echo.Map{
+			"channel_id":       video.ChannelID,
+			"channel_verified": video.ChannelVerified,
+			"title":            video.Title,
+			"description":      video.Description,
+			"tags":             video.Tags,
+			"category_id":      video.CategoryID,
+			"language":         video.Language,
+			"content_rating":   video.ContentRating,
+			"updated_at":       video.UpdatedAt,
+		}).
+		Do(context.Background())
+
+	return err
+}
+
 func (app *App) GetVideo(c echo.Context) error {
 	video, err := app.SelectVideo(c.Param("id"))
 	if err != nil {
@@ -126,10 +256,25 @@ func (app *App) GetVideo(c echo.Context) error {
 		return err
 	}
 
-	if video.Status == StatusInactive || (video.Status == StatusEncoding && ownerID != GetUserID(c)) {
+	userID := GetUserID(c)
+	if !video.Accessible(ownerID, userID) {
 		return NotFoundError("video")
 	}
 
+	if userID != "" {
+		if video.ResumePosition, err = app.selectResumePosition(video, userID); err != nil {
+			return err
+		}
+	}
+
+	if video.Captions, err = app.selectCaptionTracks(video.ID); err != nil {
+		return err
+	}
+
+	if video.Chapters, err = app.selectChapters(video.ID); err != nil {
+		return err
+	}
+
 	return c.JSON(http.StatusOK, video)
 }
 
@@ -154,6 +299,12 @@ func (app *App) GetVideos(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "value of 'limit' has to be 1~100")
 	}
 
+	filter, err := parseVideoFilter(c)
+	if err != nil {
+		return err
+	}
+	filterSQL, filterArgs := filter.sql("v")
+
 	if q := c.QueryParam("query"); q != "" {
 		search := app.es.Search().
 			Index(app.Config.Elasticsearch.VideoIndex)
@@ -172,7 +323,9 @@ func (app *App) GetVideos(c echo.Context) error {
 
 		search.Query(elastic.NewBoolQuery().Must(
 			elastic.NewRangeQuery("updated_at").Lte(searchTime),
-			elastic.NewMultiMatchQuery(q, "title^2", "description"),
+			elastic.NewMultiMatchQuery(q, "title^2", "tags^2", "description"),
+		).Filter(filter.esQueries()...).Should(
+			elastic.NewTermQuery("channel_verified", true).Boost(verifiedBoost),
 		)).
 			Size(limit+1).
 			Sort("_score", false).
@@ -199,11 +352,14 @@ func (app *App) GetVideos(c echo.Context) error {
 			return err
 		}
 
-		response.Data = make([]Video, len(res.Hits.Hits))
-		for i, hit := range res.Hits.Hits {
-			if i < limit {
-				stmt.Get(&response.Data[i], hit.Id)
-			}
+		hits := res.Hits.Hits
+		if len(hits) > limit {
+			hits = hits[:limit]
+		}
+
+		response.Data = make([]Video, len(hits))
+		for i, hit := range hits {
+			stmt.Get(&response.Data[i], hit.Id)
 		}
 	} else {
 		userId := GetUserID(c)
@@ -223,6 +379,12 @@ func (app *App) GetVideos(c echo.Context) error {
 				}
 			}
 
+			args := []interface{}{app.Config.SubscriptionBonus, userId, lastIds[0], lastIds[0]}
+			args = append(args, filterArgs...)
+			args = append(args, limit+1, userId)
+			args = append(args, filterArgs...)
+			args = append(args, lastIds[1], lastIds[1], limit+1, limit+1)
+
 			err = app.db.Unsafe().Select(&rows,
 				`SELECT * FROM
 					((SELECT v.*, UNIX_TIMESTAMP(posted_at)+? score, 1 subscription
@@ -230,22 +392,21 @@ func (app *App) GetVideos(c echo.Context) error {
 						WHERE
 							s.user_id=?
 							AND (?='' OR v.id < ?)
-							AND v.status='ACTIVE'
+							AND v.status='ACTIVE' AND v.visibility='PUBLIC'
+							AND `+filterSQL+`
 						ORDER BY v.id DESC
 						LIMIT ?)
 					UNION
 					(SELECT v.*, UNIX_TIMESTAMP(posted_at) score, 0 subscription
 						FROM videos v LEFT JOIN subscriptions s ON v.channel_id=s.channel_id AND s.user_id=?
-						WHERE s.user_id IS NULL AND v.status='ACTIVE'
+						WHERE s.user_id IS NULL AND v.status='ACTIVE' AND v.visibility='PUBLIC'
+						AND `+filterSQL+`
 						AND (?='' OR v.id < ?)
 						ORDER BY v.id DESC LIMIT ?)) a
 				GROUP BY id
 				ORDER BY score DESC
 				LIMIT ?;`,
-				app.Config.SubscriptionBonus,
-				userId, lastIds[0], lastIds[0], limit+1,
-				userId, lastIds[1], lastIds[1], limit+1,
-				limit+1,
+				args...,
 			)
 
 			if err != nil {
@@ -280,11 +441,14 @@ func (app *App) GetVideos(c echo.Context) error {
 			}
 		} else {
 			if pageToken != "" {
-				query := "SELECT * FROM videos WHERE `id` < ? AND `status`='ACTIVE' ORDER BY `id` DESC LIMIT ?"
-				err = app.db.Unsafe().Select(&response.Data, query, pageToken, limit+1)
+				query := "SELECT * FROM videos v WHERE v.`id` < ? AND v.`status`='ACTIVE' AND v.`visibility`='PUBLIC' " +
+					"AND " + filterSQL + " ORDER BY v.`id` DESC LIMIT ?"
+				err = app.db.Unsafe().Select(&response.Data, query,
+					append(append([]interface{}{pageToken}, filterArgs...), limit+1)...)
 			} else {
-				query := "SELECT * FROM videos WHERE `status`='ACTIVE' ORDER BY `id` DESC LIMIT ?"
-				err = app.db.Unsafe().Select(&response.Data, query, limit+1)
+				query := "SELECT * FROM videos v WHERE v.`status`='ACTIVE' AND v.`visibility`='PUBLIC' " +
+					"AND " + filterSQL + " ORDER BY v.`id` DESC LIMIT ?"
+				err = app.db.Unsafe().Select(&response.Data, query, append(filterArgs, limit+1)...)
 			}
 
 			if err != nil {
@@ -298,14 +462,24 @@ func (app *App) GetVideos(c echo.Context) error {
 		}
 	}
 
+	if err = app.fillVideos(response.Data); err != nil {
+		return err
+	}
+
 	return c.JSON(http.StatusOK, response)
 }
 
 func (app *App) PostVideo(c echo.Context) error {
 	body := struct {
-		ChannelID   string `json:"channel_id" validate:"required"`
-		Title       string `json:"title" validate:"required"`
-		Description string `json:"description" validate:"required"`
+		ChannelID     string        `json:"channel_id" validate:"required"`
+		Title         string        `json:"title" validate:"required"`
+		Description   string        `json:"description" validate:"required"`
+		Visibility    Visibility    `json:"visibility"`
+		PublishAt     *time.Time    `json:"publish_at"`
+		Tags          []string      `json:"tags"`
+		CategoryID    *string       `json:"category_id"`
+		Language      *string       `json:"language"`
+		ContentRating ContentRating `json:"content_rating"`
 	}{}
 	if err := c.Bind(&body); err != nil {
 		return err
@@ -314,6 +488,19 @@ func (app *App) PostVideo(c echo.Context) error {
 		return err
 	}
 
+	if err := validatePublishAt(body.Visibility, body.PublishAt); err != nil {
+		return err
+	}
+
+	tags, err := normalizeTags(body.Tags)
+	if err != nil {
+		return err
+	}
+
+	if err = app.validateVideoMetadata(body.CategoryID, body.Language); err != nil {
+		return err
+	}
+
 	userId := GetUserID(c)
 	if err := app.CheckChannelAuth(body.ChannelID, userId); err != nil {
 		return err
@@ -322,13 +509,43 @@ func (app *App) PostVideo(c echo.Context) error {
 	now := time.Now()
 	id := ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy)
 
-	query := "INSERT INTO videos (`id`, `channel_id`, `title`, `description`, `post_started_at`) " +
-		"VALUES (?, ?, ?, ?, ?)"
-	_, err := app.db.Exec(query, id.String(), body.ChannelID, body.Title, body.Description, now)
+	if body.Visibility != VisibilityScheduled {
+		body.PublishAt = nil
+	}
+
+	tx, err := app.db.Beginx()
 	if err != nil {
 		return err
 	}
 
+	query := "INSERT INTO videos (`id`, `channel_id`, `title`, `description`, `visibility`, `publish_at`, " +
+		"`category_id`, `language`, `content_rating`, `post_started_at`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err = tx.Exec(query, id.String(), body.ChannelID, body.Title, body.Description,
+		body.Visibility, body.PublishAt, nullIfEmpty(body.CategoryID), nullIfEmpty(body.Language), body.ContentRating, now)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = replaceVideoTags(tx, id.String(), tags); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = syncVideoChapters(tx, id.String(), body.Description, 0, false); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = app.insertEncodingJob(tx, id.String(), now); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
 	token := jwt.New()
 	token.Set("video_id", id)
 	signed, err := jwt.Sign(token, jwa.HS256, []byte(app.Config.UploadSignKey))
@@ -345,14 +562,20 @@ func (app *App) PostVideo(c echo.Context) error {
 func (app *App) PutVideo(c echo.Context) error {
 	videoID := c.Param("id")
 	body := struct {
-		Title       *string      `json:"title"`
-		Description *string      `json:"description"`
-		Width       *int         `json:"width"`
-		Height      *int         `json:"height"`
-		FrameRate   *int         `json:"frame_rate"`
-		Duration    *float32     `json:"duration"`
-		Status      *VideoStatus `json:"status"`
-		PostedAt    *time.Time   `json:"posted_at"`
+		Title         *string        `json:"title"`
+		Description   *string        `json:"description"`
+		Width         *int           `json:"width"`
+		Height        *int           `json:"height"`
+		FrameRate     *int           `json:"frame_rate"`
+		Duration      *float32       `json:"duration"`
+		Status        *VideoStatus   `json:"status"`
+		PostedAt      *time.Time     `json:"posted_at"`
+		Visibility    *Visibility    `json:"visibility"`
+		PublishAt     *time.Time     `json:"publish_at"`
+		Tags          *[]string      `json:"tags"`
+		CategoryID    *string        `json:"category_id"`
+		Language      *string        `json:"language"`
+		ContentRating *ContentRating `json:"content_rating"`
 	}{}
 	if err := c.Bind(&body); err != nil {
 		return err
@@ -398,6 +621,48 @@ func (app *App) PutVideo(c echo.Context) error {
 		vals = append(vals, *body.Description)
 	}
 
+	var tags []string
+	if GetUserID(c) != "" {
+		if err := app.validateVideoMetadata(body.CategoryID, body.Language); err != nil {
+			return err
+		}
+
+		if body.CategoryID != nil {
+			params = append(params, "`category_id`=?")
+			vals = append(vals, nullIfEmpty(body.CategoryID))
+		}
+
+		if body.Language != nil {
+			params = append(params, "`language`=?")
+			vals = append(vals, nullIfEmpty(body.Language))
+		}
+
+		if body.ContentRating != nil {
+			params = append(params, "`content_rating`=?")
+			vals = append(vals, *body.ContentRating)
+		}
+
+		if body.Tags != nil {
+			var err error
+			if tags, err = normalizeTags(*body.Tags); err != nil {
+				return err
+			}
+		}
+	}
+
+	if body.Visibility != nil && GetUserID(c) != "" {
+		if err := validatePublishAt(*body.Visibility, body.PublishAt); err != nil {
+			return err
+		}
+
+		if *body.Visibility != VisibilityScheduled {
+			body.PublishAt = nil
+		}
+
+		params = append(params, "`visibility`=?", "`publish_at`=?")
+		vals = append(vals, *body.Visibility, body.PublishAt)
+	}
+
 	if editMeta {
 		if body.Width != nil {
 			params = append(params, "`width`=?")
@@ -436,40 +701,65 @@ func (app *App) PutVideo(c echo.Context) error {
 		}
 	}
 
-	if len(params) == 0 {
+	if len(params) == 0 && tags == nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "no available property")
 	}
 
-	query := "UPDATE videos" +
-		" SET " + strings.Join(params, ",") + ", `updated_at`=CURRENT_TIMESTAMP()" +
-		" WHERE `id`=?"
-	res, err := app.db.Exec(query, append(vals, videoID)...)
+	prev, err := app.SelectVideo(videoID)
 	if err != nil {
 		return err
 	}
-	if rows, err := res.RowsAffected(); err != nil {
+
+	tx, err := app.db.Beginx()
+	if err != nil {
 		return err
-	} else if rows == 0 {
-		return NotFoundError("video")
 	}
 
-	if video, err := app.SelectVideo(videoID); err == nil {
-		if editMeta || body.Title != nil || body.Description != nil {
-			app.es.Index().
-				Index(app.Config.Elasticsearch.VideoIndex).
-				Id(videoID).
-				BodyJson(echo.Map{
-					"title":       video.Title,
-					"description": video.Description,
-					"updated_at":  video.UpdatedAt,
-				}).
-				Do(context.Background())
+	params = append(params, "`updated_at`=CURRENT_TIMESTAMP()")
+	query := "UPDATE videos SET " + strings.Join(params, ",") + " WHERE `id`=?"
+	if _, err = tx.Exec(query, append(vals, videoID)...); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if tags != nil {
+		if err = replaceVideoTags(tx, videoID, tags); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if body.Description != nil || (editMeta && body.Duration != nil) {
+		description, duration := prev.Description, float64(prev.Duration)
+		if body.Description != nil {
+			description = *body.Description
+		}
+		if editMeta && body.Duration != nil {
+			duration = float64(*body.Duration)
 		}
 
+		if err = syncVideoChapters(tx, videoID, description, duration, prev.ChaptersExplicit); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if video, err := app.SelectVideo(videoID); err == nil {
 		if editMeta && body.Status != nil && *body.Status == StatusActive {
-			room := fmt.Sprintf("video/%s/encode", videoID)
-			app.ws.Publish(room, "encoded", video)
-			app.ws.UnsubscribeAll(room)
+			p := &EncodingProgress{VideoID: videoID, State: EncodingEncoded, Percent: 100, UpdatedAt: time.Now()}
+			if err := app.reportEncoding(p, video); err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		if !prev.Listed() && video.Listed() {
+			app.publishVideo(video)
+		} else {
+			app.indexVideo(video)
 		}
 
 		return c.JSON(http.StatusOK, video)
@@ -499,66 +789,7 @@ func (app *App) DeleteVideo(c echo.Context) error {
 		return err
 	}
 
-	app.es.Delete().
-		Index(app.Config.Elasticsearch.VideoIndex).
-		Id(videoID).
-		Do(context.Background())
-
-	return c.NoContent(http.StatusNoContent)
-}
-
-func (app *App) PutThumbnail(c echo.Context) error {
-	videoID := c.Param("id")
-
-	var owner string
-
-	query := "SELECT c.`owner` FROM videos v JOIN channels c ON v.`channel_id`=c.`id` WHERE v.`id`=?"
-	if err := app.db.Get(&owner, query, videoID); err == sql.ErrNoRows {
-		return NotFoundError("video")
-	} else if err != nil {
-		return err
-	}
-
-	if owner != GetUserID(c) {
-		return echo.NewHTTPError(http.StatusForbidden, "you don't have permission on this video")
-	}
-
-	header, err := c.FormFile("file")
-	if err != nil {
-		return err
-	}
-
-	file, err := header.Open()
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	img, err := imaging.Decode(file)
-	if err != nil {
-		return err
-	}
-
-	resized := imaging.Resize(img, app.Config.Thumbnail.Width, app.Config.Thumbnail.Height, imaging.Lanczos)
-	temp, err := ioutil.TempFile("", "thumbnail")
-	if err != nil {
-		return err
-	}
-	defer os.Remove(temp.Name())
-
-	err = imaging.Encode(temp, resized, imaging.JPEG, imaging.JPEGQuality(app.Config.Thumbnail.Quality))
-	if err != nil {
-		temp.Close()
-		return err
-	}
-
-	if err = temp.Close(); err != nil {
-		return err
-	}
-
-	if err = app.videoStorage.storeFile(temp.Name(), videoID+"/thumbnail.jpg"); err != nil {
-		return err
-	}
+	app.unindexVideo(videoID)
 
 	return c.NoContent(http.StatusNoContent)
 }
@@ -587,7 +818,7 @@ func (app *App) GetVideoComments(c echo.Context) error {
 	}
 
 	sql := "SELECT 1 FROM videos v JOIN channels c ON c.`id`=v.`channel_id` " +
-		"WHERE v.`id`=? AND (v.`status`='ACTIVE' OR (v.`status`='ENCODING' AND c.`owner`=?))"
+		"WHERE v.`id`=? AND " + videoAccessCondition
 	rows, err := app.db.Queryx(sql, videoID, GetUserID(c))
 	if err != nil {
 		return err
@@ -747,6 +978,7 @@ func (app *App) PutExpression(c echo.Context) error {
 	}
 
 	var exp Expression
+	var likes, dislikes int
 	query = "SELECT `type` FROM expressions WHERE `video_id`=? AND `user_id`=? FOR UPDATE"
 	if err = tx.Get(&exp, query, videoId, userId); err == nil {
 		if exp == body.Type {
@@ -755,24 +987,30 @@ func (app *App) PutExpression(c echo.Context) error {
 			return c.JSON(http.StatusOK, response)
 		} else if exp == ExpressionLike {
 			response.Likes--
+			likes--
 		} else {
 			response.Dislikes--
+			dislikes--
 		}
 	} else if err != sql.ErrNoRows {
 		tx.Rollback()
 		return err
 	}
 
-	query = "INSERT INTO expressions VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `type`=?"
-	if _, err = tx.Exec(query, videoId, userId, body.Type, body.Type); err != nil {
+	now := time.Now()
+	query = "INSERT INTO expressions (`video_id`, `user_id`, `type`, `expressed_at`) VALUES (?, ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE `type`=?, `expressed_at`=?"
+	if _, err = tx.Exec(query, videoId, userId, body.Type, now, body.Type, now); err != nil {
 		tx.Rollback()
 		return err
 	}
 
 	if body.Type == ExpressionLike {
 		response.Likes++
+		likes++
 	} else {
 		response.Dislikes++
+		dislikes++
 	}
 
 	query = "UPDATE videos SET `likes`=?, `dislikes`=? WHERE `id`=?"
@@ -781,6 +1019,11 @@ func (app *App) PutExpression(c echo.Context) error {
 		return err
 	}
 
+	if err = recordVideoStat(tx, videoId, now, likes, dislikes, 0); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	if err = tx.Commit(); err != nil {
 		return err
 	}
@@ -829,10 +1072,13 @@ func (app *App) DeleteExpression(c echo.Context) error {
 		return err
 	}
 
+	likes, dislikes := 0, 0
 	if exp == ExpressionLike {
 		response.Likes--
+		likes--
 	} else {
 		response.Dislikes--
+		dislikes--
 	}
 
 	query = "UPDATE videos SET `likes`=?, `dislikes`=? WHERE `id`=?"
@@ -841,13 +1087,19 @@ func (app *App) DeleteExpression(c echo.Context) error {
 		return err
 	}
 
+	if err = recordVideoStat(tx, videoId, time.Now(), likes, dislikes, 0); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	tx.Commit()
 	return c.JSON(http.StatusOK, response)
 }
 
 type Comment struct {
 	ID            string     `json:"id" db:"id"`
-	VideoID       string     `json:"video_id" db:"video_id"`
+	VideoID       *string    `json:"video_id" db:"video_id"`
+	PostID        *string    `json:"post_id" db:"post_id"`
 	Content       string     `json:"content" db:"content"`
 	WriterID      string     `json:"writer_id" db:"writer_id"`
 	PostedAt      time.Time  `json:"posted_at" db:"posted_at"`
@@ -867,30 +1119,51 @@ func (app *App) SelectComment(id string) (c *Comment, err error) {
 func (app *App) PostComment(c echo.Context) error {
 	body := struct {
 		VideoID string `json:"video_id"`
+		PostID  string `json:"post_id"`
 		Content string `json:"content"`
 	}{}
 	if err := c.Bind(&body); err != nil {
 		return err
 	}
 
-	query := "INSERT INTO comments (`id`, `video_id`, `content`, `writer_id`, `posted_at`) " +
-		"SELECT ?, v.`id`, ?, ?, ? FROM videos v JOIN channels c ON c.`id`=v.`channel_id` " +
-		"WHERE v.`id`=? AND (v.`status`='ACTIVE' OR (v.`status`='ENCODING' AND c.`owner`=?))"
+	if (body.VideoID == "") == (body.PostID == "") {
+		return echo.NewHTTPError(http.StatusBadRequest, "either field 'video_id' or 'post_id' is needed")
+	}
 
 	now := time.Now()
 	id := ulid.MustNew(ulid.Timestamp(now), app.ulidEntropy)
-
 	userId := GetUserID(c)
-	res, err := app.db.Exec(query, id.String(), body.Content, userId, now, body.VideoID, userId)
+
+	var res sql.Result
+	var err error
+	if body.VideoID != "" {
+		query := "INSERT INTO comments (`id`, `video_id`, `content`, `writer_id`, `posted_at`) " +
+			"SELECT ?, v.`id`, ?, ?, ? FROM videos v JOIN channels c ON c.`id`=v.`channel_id` " +
+			"WHERE v.`id`=? AND " + videoAccessCondition
+		res, err = app.db.Exec(query, id.String(), body.Content, userId, now, body.VideoID, userId)
+	} else {
+		query := "INSERT INTO comments (`id`, `post_id`, `content`, `writer_id`, `posted_at`) " +
+			"SELECT ?, p.`id`, ?, ?, ? FROM posts p WHERE p.`id`=? AND p.`deactivated_at` IS NULL"
+		res, err = app.db.Exec(query, id.String(), body.Content, userId, now, body.PostID)
+	}
+
 	if err != nil {
 		return err
 	}
 
 	if rows, err := res.RowsAffected(); err != nil {
 		return err
-	} else if rows == 0 {
+	} else if rows == 0 && body.VideoID != "" {
 		return NotFoundError("video")
+	} else if rows == 0 {
+		return NotFoundError("post")
 	} else {
+		if body.VideoID != "" {
+			if err = recordVideoStat(app.db, body.VideoID, now, 0, 0, 1); err != nil {
+				return err
+			}
+		}
+
 		comment, _ := app.SelectComment(id.String())
 		return c.JSON(http.StatusOK, comment)
 	}
@@ -899,8 +1172,11 @@ func (app *App) PostComment(c echo.Context) error {
 func (app *App) DeleteComment(c echo.Context) error {
 	commentID := c.Param("id")
 
-	var writer string
-	err := app.db.Get(&writer, "SELECT `writer_id` FROM comments WHERE `id`=?", commentID)
+	var comment struct {
+		WriterID string  `db:"writer_id"`
+		VideoID  *string `db:"video_id"`
+	}
+	err := app.db.Get(&comment, "SELECT `writer_id`, `video_id` FROM comments WHERE `id`=?", commentID)
 	if err == sql.ErrNoRows {
 		return NotFoundError("comment")
 	}
@@ -908,14 +1184,22 @@ func (app *App) DeleteComment(c echo.Context) error {
 		return err
 	}
 
-	if writer != GetUserID(c) {
+	if comment.WriterID != GetUserID(c) {
 		return echo.NewHTTPError(http.StatusForbidden, "you don't have permission on this comment")
 	}
 
-	sql := "DELETE FROM comments WHERE `id`=?"
-	if _, err = app.db.Exec(sql, commentID); err == nil {
-		return c.NoContent(http.StatusNoContent)
-	} else {
+	res, err := app.db.Exec("DELETE FROM comments WHERE `id`=?", commentID)
+	if err != nil {
+		return err
+	}
+
+	if rows, err := res.RowsAffected(); err != nil {
 		return err
+	} else if rows > 0 && comment.VideoID != nil {
+		if err = recordVideoStat(app.db, *comment.VideoID, time.Now(), 0, 0, -1); err != nil {
+			return err
+		}
 	}
+
+	return c.NoContent(http.StatusNoContent)
 }
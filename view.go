@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// maxViewsPerIP is the number of views counted from an IP address for a
+// video in the deduplication window. It keeps viewers behind a shared
+// address countable while limiting sessions forged by one client.
+const maxViewsPerIP = 20
+
+var botPattern = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|curl|wget|python|java/|go-http-client|headless|phantom`)
+
+// viewCounter deduplicates views and buffers the increments until they are
+// flushed into the database.
+type viewCounter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	seen    map[string]time.Time
+	ips     map[string]*ipViews
+	pending map[string]uint64
+}
+
+type ipViews struct {
+	count   int
+	expires time.Time
+}
+
+func newViewCounter(window time.Duration) *viewCounter {
+	return &viewCounter{
+		window:  window,
+		seen:    map[string]time.Time{},
+		ips:     map[string]*ipViews{},
+		pending: map[string]uint64{},
+	}
+}
+
+// add counts a view of the video by the viewer from the IP address unless
+// the viewer or the address has already viewed it in the window.
+func (vc *viewCounter) add(videoID string, viewer string, ip string, now time.Time) bool {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	key := videoID + "/" + viewer
+	if expires, ok := vc.seen[key]; ok && now.Before(expires) {
+		return false
+	}
+
+	ipKey := videoID + "/" + ip
+	v, ok := vc.ips[ipKey]
+	if !ok || !now.Before(v.expires) {
+		v = &ipViews{expires: now.Add(vc.window)}
+		vc.ips[ipKey] = v
+	}
+
+	if v.count >= maxViewsPerIP {
+		return false
+	}
+
+	v.count++
+	vc.seen[key] = now.Add(vc.window)
+	vc.pending[videoID]++
+	return true
+}
+
+// take returns the buffered increments and forgets expired records.
+func (vc *viewCounter) take(now time.Time) map[string]uint64 {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for key, expires := range vc.seen {
+		if !now.Before(expires) {
+			delete(vc.seen, key)
+		}
+	}
+
+	for key, v := range vc.ips {
+		if !now.Before(v.expires) {
+			delete(vc.ips, key)
+		}
+	}
+
+	pending := vc.pending
+	vc.pending = map[string]uint64{}
+	return pending
+}
+
+// restore puts back increments which failed to be flushed.
+func (vc *viewCounter) restore(pending map[string]uint64) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for videoID, n := range pending {
+		vc.pending[videoID] += n
+	}
+}
+
+func (app *App) PostVideoView(c echo.Context) error {
+	body := struct {
+		Watched   *float64 `json:"watched" validate:"required,min=0"`
+		SessionID string   `json:"session_id" validate:"max=64"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if err := c.Validate(body); err != nil {
+		return err
+	}
+
+	videoID := c.Param("id")
+	userID := GetUserID(c)
+
+	var duration float64
+	query := "SELECT v.`duration` FROM videos v JOIN channels c ON c.`id`=v.`channel_id` " +
+		"WHERE v.`id`=? AND " + videoAccessCondition
+	if err := app.db.Get(&duration, query, videoID, userID); err == sql.ErrNoRows {
+		return NotFoundError("video")
+	} else if err != nil {
+		return err
+	}
+
+	response := struct {
+		Counted bool `json:"counted"`
+	}{}
+
+	// A view is counted after watching the threshold or a half of a short video.
+	threshold := float64(app.Config.ViewThreshold)
+	if duration > 0 && duration/2 < threshold {
+		threshold = duration / 2
+	}
+
+	ua := c.Request().UserAgent()
+	if *body.Watched < threshold || ua == "" || botPattern.MatchString(ua) {
+		return c.JSON(http.StatusOK, response)
+	}
+
+	viewer := viewerKey(c, userID, body.SessionID)
+	response.Counted = app.views.add(videoID, viewer, c.RealIP(), time.Now())
+	return c.JSON(http.StatusOK, response)
+}
+
+// flushViews adds the buffered views to the counters and the daily
+// statistics of videos.
+func (app *App) flushViews() error {
+	now := time.Now()
+	date := now.UTC().Format(dateLayout)
+	pending := app.views.take(now)
+
+	for videoID, n := range pending {
+		tx, err := app.db.Beginx()
+		if err != nil {
+			app.views.restore(pending)
+			return err
+		}
+
+		query := "INSERT INTO video_stats (`video_id`, `date`, `views`) VALUES (?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE `views`=`views`+VALUES(`views`)"
+		if _, err = tx.Exec("UPDATE videos SET `views`=`views`+? WHERE `id`=?", n, videoID); err == nil {
+			_, err = tx.Exec(query, videoID, date, n)
+		}
+
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+
+		if err != nil && !isForeignKeyError(err) {
+			app.views.restore(pending)
+			return err
+		}
+
+		delete(pending, videoID)
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type Visibility int
+
+const (
+	VisibilityPublic Visibility = iota
+	VisibilityUnlisted
+	VisibilityPrivate
+	VisibilityScheduled
+)
+
+func (v Visibility) String() string {
+	switch v {
+	case VisibilityPublic:
+		return "PUBLIC"
+	case VisibilityUnlisted:
+		return "UNLISTED"
+	case VisibilityPrivate:
+		return "PRIVATE"
+	case VisibilityScheduled:
+		return "SCHEDULED"
+	}
+
+	return ""
+}
+
+func parseVisibility(s string) (Visibility, error) {
+	switch strings.ToUpper(s) {
+	case "PUBLIC":
+		return VisibilityPublic, nil
+	case "UNLISTED":
+		return VisibilityUnlisted, nil
+	case "PRIVATE":
+		return VisibilityPrivate, nil
+	case "SCHEDULED":
+		return VisibilityScheduled, nil
+	}
+
+	return 0, errors.New("invalid value for Visibility")
+}
+
+func (v Visibility) Value() (driver.Value, error) {
+	return v.String(), nil
+}
+
+func (v *Visibility) Scan(src interface{}) (err error) {
+	switch src.(type) {
+	case string:
+		*v, err = parseVisibility(src.(string))
+	case []byte:
+		*v, err = parseVisibility(string(src.([]byte)))
+	default:
+		err = errors.New("invalid type for Visibility")
+	}
+	return
+}
+
+func (v Visibility) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func (v *Visibility) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	*v, err = parseVisibility(s)
+	return err
+}
+
+func validatePublishAt(visibility Visibility, publishAt *time.Time) error {
+	if visibility != VisibilityScheduled {
+		return nil
+	}
+
+	if publishAt == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "field 'publish_at' is needed for a scheduled video")
+	}
+
+	if !publishAt.After(time.Now()) {
+		return echo.NewHTTPError(http.StatusBadRequest, "field 'publish_at' has to be in the future")
+	}
+
+	return nil
+}
+
+// videoAccessCondition is the SQL condition of videos v on channels c which
+// can be watched by the user given as its parameter. Unlisted videos are
+// open to anyone who knows their ID, and the owner can watch every video
+// which is not deleted.
+const videoAccessCondition = "(v.`status`<>'INACTIVE' AND (c.`owner`=? OR " +
+	"(v.`status`='ACTIVE' AND v.`visibility` IN ('PUBLIC','UNLISTED'))))"
+
+// Listed reports whether the video is shown in lists, feeds and search results.
+func (v *Video) Listed() bool {
+	return v.Status == StatusActive && v.Visibility == VisibilityPublic
+}
+
+// Accessible reports whether the user can watch the video of the channel
+// owned by ownerID.
+func (v *Video) Accessible(ownerID string, userID string) bool {
+	if v.Status == StatusInactive {
+		return false
+	}
+
+	if userID != "" && ownerID == userID {
+		return true
+	}
+
+	return v.Status == StatusActive && (v.Visibility == VisibilityPublic || v.Visibility == VisibilityUnlisted)
+}
+
+// publishScheduledVideos publishes scheduled videos whose publish time has
+// come. Every node may run it since a video is published by only one of them.
+func (app *App) publishScheduledVideos() error {
+	var ids []string
+	query := "SELECT `id` FROM videos WHERE `visibility`='SCHEDULED' AND `status`='ACTIVE' AND `publish_at` <= ?"
+	if err := app.db.Select(&ids, query, time.Now()); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		query = "UPDATE videos SET `visibility`='PUBLIC', `posted_at`=`publish_at`, `updated_at`=CURRENT_TIMESTAMP() " +
+			"WHERE `id`=? AND `visibility`='SCHEDULED'"
+		res, err := app.db.Exec(query, id)
+		if err != nil {
+			return err
+		}
+
+		if rows, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			continue
+		}
+
+		video, err := app.SelectVideo(id)
+		if err != nil {
+			return err
+		}
+
+		app.publishVideo(video)
+	}
+
+	return nil
+}
+
+// publishVideo fires the events of a video which has just been listed.
+func (app *App) publishVideo(video *Video) {
+	if err := app.indexVideo(video); err != nil {
+		fmt.Println(err)
+	}
+
+	go func() {
+		if err := app.notifyNewVideo(video); err != nil {
+			fmt.Println(err)
+		}
+	}()
+}
+
+// unindexVideo removes the video from the search index if it exists.
+func (app *App) unindexVideo(videoID string) {
+	app.es.Delete().
+		Index(app.Config.Elasticsearch.VideoIndex).
+		Id(videoID).
+		Do(context.Background())
+}
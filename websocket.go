@@ -14,21 +14,35 @@ func (app *App) ServeWebsocket(c echo.Context) error {
 
 	userID, _ := app.AuthUser(c.QueryParam("authorization"))
 	client.On("join", new(string), func(data interface{}) {
-		if p, ok := data.(*string); ok {
-			if s := strings.Split(*p, "/"); s[0] == "video" && s[2] == "encode" {
-				video, err := app.SelectVideo(s[1])
-				if err != nil {
-					return
-				}
-
-				ownerID, err := app.SelectChannelOwnerID(video.ChannelID)
-				if err != nil {
-					return
-				}
-
-				if ownerID == userID {
-					client.Subscribe(*p)
-				}
+		p, ok := data.(*string)
+		if !ok {
+			return
+		}
+
+		s := strings.Split(*p, "/")
+		switch {
+		case len(s) == 3 && s[0] == "video" && s[2] == "encode":
+			video, err := app.SelectVideo(s[1])
+			if err != nil {
+				return
+			}
+
+			ownerID, err := app.SelectChannelOwnerID(video.ChannelID)
+			if err != nil {
+				return
+			}
+
+			if ownerID == userID {
+				client.Subscribe(encodeRoom(video.ID))
+				app.emitEncodingProgress(client, video.ID)
+			}
+		case len(s) == 3 && s[0] == "post" && s[2] == "poll":
+			if _, err := app.SelectPost(s[1]); err == nil {
+				client.Subscribe(pollRoom(s[1]))
+			}
+		case len(s) == 2 && s[0] == "user":
+			if userID != "" && s[1] == userID {
+				client.Subscribe(notificationRoom(userID))
 			}
 		}
 	})